@@ -0,0 +1,358 @@
+package instrumentedsql
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuditRecord is the record of a statement which writes, or of the end of a transaction which did, see WithAuditSink
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Actor is the actor set with WithAuditActor on the context of the call
+	Actor string `json:"actor,omitempty"`
+	Op    string `json:"op"`
+	// Operation and Tables are the classification of the statement, the operation of the end of a transaction
+	// is either COMMIT or ROLLBACK
+	Operation string     `json:"operation"`
+	Tables    []string   `json:"tables,omitempty"`
+	Query     string     `json:"query,omitempty"`
+	Args      []AuditArg `json:"args,omitempty"`
+	// RowsAffected is set for exec ops, if supported by the driver
+	RowsAffected *int64 `json:"rows_affected,omitempty"`
+	// TxID identifies the transaction the statement was made in, it is unique within the process
+	TxID   string `json:"tx_id,omitempty"`
+	ConnID uint64 `json:"conn_id,omitempty"`
+	// Err is set for failed attempts, which are only audited with WithAuditFailures
+	Err      string        `json:"err,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// AuditArg is a query argument of an AuditRecord, its value is only included if the AuditArgRedactor keeps it
+type AuditArg struct {
+	Name    string         `json:"name,omitempty"`
+	Ordinal int            `json:"ordinal"`
+	Type    string         `json:"type"`
+	Value   *RecordedValue `json:"value,omitempty"`
+}
+
+// AuditArgRedactor returns the value of arg to include in audit records, if it is to be kept at all
+type AuditArgRedactor func(query string, arg driver.NamedValue) (value driver.Value, keep bool)
+
+// AuditSink receives the audit records of a wrapped driver, see WithAuditSink.
+// Write is called synchronously by the audited call, once it returns.
+type AuditSink interface {
+	Write(ctx context.Context, record AuditRecord) error
+}
+
+// auditFlusher is implemented by sinks which buffer their writes, they are flushed when the wrapped connector is closed
+type auditFlusher interface {
+	Flush() error
+}
+
+type auditActorKey struct{}
+
+// WithAuditActor returns a context whose calls are audited as made by actor, such as the ID of an authenticated user
+func WithAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// AuditActor returns the actor set on ctx with WithAuditActor
+func AuditActor(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	actor, _ := ctx.Value(auditActorKey{}).(string)
+	return actor
+}
+
+// JSONLinesAuditSink writes audit records to a writer as JSON lines, through a buffer.
+// It surfaces the first error it encounters to every following write, and from Flush and Close.
+type JSONLinesAuditSink struct {
+	mu     sync.Mutex
+	buf    *bufio.Writer
+	enc    *json.Encoder
+	closer io.Closer
+	err    error
+	closed bool
+	stop   chan struct{}
+}
+
+// NewJSONLinesAuditSink returns a sink writing to w, which is not closed by the sink.
+// If flushInterval is positive, the buffer is flushed at that interval, otherwise only when full,
+// on Flush and on Close.
+func NewJSONLinesAuditSink(w io.Writer, flushInterval time.Duration) *JSONLinesAuditSink {
+	s := &JSONLinesAuditSink{buf: bufio.NewWriter(w)}
+	s.enc = json.NewEncoder(s.buf)
+
+	if flushInterval > 0 {
+		s.stop = make(chan struct{})
+		go s.flushEvery(flushInterval)
+	}
+
+	return s
+}
+
+// OpenAuditFile returns a sink appending to the file at path, which is created if needed and closed along with the sink
+func OpenAuditFile(path string, flushInterval time.Duration) (*JSONLinesAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewJSONLinesAuditSink(f, flushInterval)
+	s.closer = f
+	return s, nil
+}
+
+// Write buffers record as a JSON line
+func (s *JSONLinesAuditSink) Write(ctx context.Context, record AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	if s.closed {
+		return errAuditSinkClosed
+	}
+	s.err = s.enc.Encode(record)
+
+	return s.err
+}
+
+// Flush writes the buffered records to the underlying writer
+func (s *JSONLinesAuditSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush()
+}
+
+// Close flushes the buffered records and stops the sink, closing the file it was opened with by OpenAuditFile
+func (s *JSONLinesAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return s.err
+	}
+	s.closed = true
+	if s.stop != nil {
+		close(s.stop)
+	}
+
+	err := s.flush()
+	if f, ok := s.closer.(*os.File); ok && err == nil {
+		err = f.Sync()
+	}
+	if s.closer != nil {
+		if closeErr := s.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// flush flushes the buffer, s.mu must be held
+func (s *JSONLinesAuditSink) flush() error {
+	if s.err != nil {
+		return s.err
+	}
+	s.err = s.buf.Flush()
+
+	return s.err
+}
+
+func (s *JSONLinesAuditSink) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+var errAuditSinkClosed = fmt.Errorf("instrumentedsql: audit sink is closed")
+
+// AuditError is returned for calls failed because their audit record could not be written, see WithAuditRequired
+type AuditError struct {
+	Op string
+	// Err is the error returned by the AuditSink
+	Err error
+}
+
+func (e *AuditError) Error() string {
+	return "instrumentedsql: " + e.Op + " could not be audited: " + e.Err.Error()
+}
+
+// Unwrap returns the error returned by the AuditSink
+func (e *AuditError) Unwrap() error {
+	return e.Err
+}
+
+// txCounter is used to hand out transaction IDs that are unique within the process
+var txCounter uint64
+
+// audit writes the audit record of call to the audit sink, if the call is audited, and returns the error of call.
+// Calls are audited regardless of WithOpsExcluded, errors writing them are logged under OpSQLAudit, and fail
+// successful statements with an AuditError if required.
+func (o opts) audit(ctx context.Context, call *Call, start time.Time, err error) error {
+	if o.AuditSink == nil || err == driver.ErrSkip || err != nil && !o.AuditFailures {
+		return err
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	record := AuditRecord{
+		Time:     start,
+		Actor:    AuditActor(ctx),
+		Op:       call.Op,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		record.Err = err.Error()
+	}
+	if o.conn != nil {
+		record.ConnID = o.conn.id
+	}
+
+	switch call.Op {
+	case OpSQLConnExec, OpSQLConnQuery, OpSQLStmtExec, OpSQLStmtQuery:
+		statement := call.Statement()
+		if statement.ReadOnly() {
+			return err
+		}
+		record.Operation, record.Tables = statement.Operation, statement.Tables
+		record.Query = call.Query
+		if !o.OmitArgs {
+			record.Args = o.auditArgs(call.Query, call.Args)
+		}
+		if call.Result != nil {
+			res := call.Result
+			if wrapped, ok := res.(wrappedResult); ok {
+				// Avoid tracing the call made to audit the result
+				res = wrapped.parent
+			}
+			if n, err := res.RowsAffected(); err == nil {
+				record.RowsAffected = &n
+			}
+		}
+		record.TxID = o.conn.auditTx()
+	case OpSQLTxCommit, OpSQLTxRollback:
+		id, audited := o.conn.tx()
+		if !audited {
+			return err
+		}
+		record.Operation, record.TxID = "COMMIT", id
+		if call.Op == OpSQLTxRollback {
+			record.Operation = "ROLLBACK"
+		}
+	default:
+		return err
+	}
+
+	writeErr := o.AuditSink.Write(ctx, record)
+	if writeErr == nil {
+		return err
+	}
+	o.Log(ctx, OpSQLAudit, "op", call.Op, "query", call.Query, "err", writeErr)
+	if !o.AuditRequired || err != nil || call.Op == OpSQLTxCommit || call.Op == OpSQLTxRollback {
+		return err
+	}
+
+	if call.Rows != nil {
+		call.Rows.Close()
+		call.Rows = nil
+	}
+	call.Result = nil
+	return &AuditError{Op: call.Op, Err: writeErr}
+}
+
+// auditArgs returns the arguments of query as redacted by the AuditArgRedactor, only their types are kept by default
+func (o opts) auditArgs(query string, args []driver.NamedValue) []AuditArg {
+	audited := make([]AuditArg, 0, len(args))
+	for _, arg := range args {
+		a := AuditArg{Name: arg.Name, Ordinal: arg.Ordinal, Type: fmt.Sprintf("%T", arg.Value)}
+		if arg.Value == nil {
+			a.Type = "nil"
+		}
+		if o.AuditArgRedactor != nil {
+			if value, keep := o.AuditArgRedactor(query, arg); keep {
+				a.Value = &RecordedValue{value}
+			}
+		}
+		audited = append(audited, a)
+	}
+
+	return audited
+}
+
+// beginTx assigns an ID to the transaction begun on the connection
+func (i *connInfo) beginTx() {
+	if i == nil {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.txID = strconv.FormatUint(atomic.AddUint64(&txCounter, 1), 10)
+	i.txAudited = false
+}
+
+// endTx forgets the transaction of the connection once committed or rolled back
+func (i *connInfo) endTx() {
+	if i == nil {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.txID, i.txAudited = "", false
+}
+
+// tx returns the ID of the transaction open on the connection, if any, and whether any of its statements was audited
+func (i *connInfo) tx() (string, bool) {
+	if i == nil {
+		return "", false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.txID, i.txAudited
+}
+
+// auditTx returns the ID of the transaction open on the connection, if any, marking it as audited
+func (i *connInfo) auditTx() string {
+	if i == nil {
+		return ""
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.txID != "" {
+		i.txAudited = true
+	}
+
+	return i.txID
+}
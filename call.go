@@ -0,0 +1,387 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+
+	"github.com/luna-duclos/instrumentedsql/sqlclass"
+)
+
+// Call describes a call made through the wrapped driver, as it is passed along the interceptor chain
+type Call struct {
+	// Op is the op of the call, such as OpSQLConnQuery
+	Op string
+	// Query and Args are set for ops which run a query. Interceptors may change them before calling next.
+	Query string
+	Args  []driver.NamedValue
+	// Result is set once an exec op returns, Rows once a query op returns
+	Result driver.Result
+	Rows   driver.Rows
+
+	// call instruments the call, it is nil if the op is excluded
+	call *call
+	// attempt is the retry attempt of the call, if tracked
+	attempt attempt
+	// fallbackOp is the op database/sql fell back from, for prepares and the statements they return
+	fallbackOp string
+	// originalQuery is the query before it was rewritten, if it was
+	originalQuery string
+	// statement is the classification of classifiedQuery
+	statement       sqlclass.Statement
+	classifiedQuery string
+}
+
+// SetLabel sets a label on the span and log line of the call, it does nothing if the op is excluded
+func (c *Call) SetLabel(k, v string) {
+	c.call.setLabel(k, v)
+}
+
+// Statement returns the classification of the query of the call, statements are classified once when prepared
+func (c *Call) Statement() sqlclass.Statement {
+	if c.Query != c.classifiedQuery {
+		c.statement, c.classifiedQuery = sqlclass.Classify(c.Query), c.Query
+	}
+
+	return c.statement
+}
+
+// Interceptor wraps the calls made through the wrapped driver, see WithInterceptor.
+// It must call next, with ctx or a context derived from it, to continue along the chain and eventually forward
+// the call to the wrapped driver, unless it fails the call itself. The error returned by next is that of the call.
+type Interceptor func(ctx context.Context, call *Call, next func(ctx context.Context) error) error
+
+// intercept passes call along the interceptor chain, ending with fn, which forwards the call to the wrapped driver
+func (o opts) intercept(ctx context.Context, call *Call, fn func(ctx context.Context) error) error {
+	call.call = o.newCall(ctx, call)
+	o.detectNPlusOne(ctx, call)
+
+	next := func(ctx context.Context) error {
+		call.call.refreshQuery(call)
+		return fn(ctx)
+	}
+	for i := len(o.Interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := o.Interceptors[i], next
+		next = func(ctx context.Context) error {
+			return interceptor(ctx, call, inner)
+		}
+	}
+
+	start := time.Now()
+	err := next(ctx)
+	call.call.finishRecording(err)
+	o.collectStats(ctx, call, time.Since(start), err)
+
+	return o.audit(ctx, call, start, err)
+}
+
+// TracingInterceptor traces every call as a child span of the span contained in its context.
+// It is part of the default interceptor chain.
+func TracingInterceptor(ctx context.Context, call *Call, next func(ctx context.Context) error) error {
+	c := call.call
+	if c == nil || c.untraced {
+		return next(ctx)
+	}
+
+	c.startSpan(ctx)
+	err := next(ctx)
+	c.finishSpan(ctx, err)
+
+	return err
+}
+
+// LoggingInterceptor logs every call, along with its labels, duration and error, to the logger.
+// It is part of the default interceptor chain.
+func LoggingInterceptor(ctx context.Context, call *Call, next func(ctx context.Context) error) error {
+	c := call.call
+	if c == nil {
+		return next(ctx)
+	}
+
+	start := time.Now()
+	err := next(ctx)
+	c.log(ctx, err, time.Since(start))
+
+	return err
+}
+
+// MetricsInterceptor observes the duration of every call, in seconds, with the metrics sink.
+// It is part of the default interceptor chain.
+func MetricsInterceptor(ctx context.Context, call *Call, next func(ctx context.Context) error) error {
+	c := call.call
+	if c == nil {
+		return next(ctx)
+	}
+
+	start := time.Now()
+	err := next(ctx)
+	c.observe(ctx, err, time.Since(start))
+
+	return err
+}
+
+// call tracks a single instrumented operation and records it on a span, the logger and the metrics sink
+type call struct {
+	opts
+	ctx     context.Context
+	op      string
+	span    Span
+	start   time.Time
+	keyvals []interface{}
+	// untraced calls are only logged and measured
+	untraced bool
+	// recording is set when calls are recorded through WithQueryRecorder
+	recording *recording
+	// query is the query the call is labeled with
+	query string
+}
+
+// outcome is how the error a call finished with is reported
+type outcome struct {
+	// expected errors are not reported as failures
+	expected bool
+	status   string
+	category ErrorCategory
+}
+
+// newCall starts instrumenting call, labeling it with everything known before it is made.
+// It returns nil if its op is excluded.
+func (o opts) newCall(ctx context.Context, ic *Call) *call {
+	if o.hasOpExcluded(ic.Op) {
+		return nil
+	}
+
+	op, untraced := ic.Op, false
+	if ic.fallbackOp != "" && o.CollapseFallback {
+		// A collapsed fallback is traced as a single span named after the op database/sql fell back from,
+		// the prepare and close around it are only logged
+		switch op {
+		case OpSQLPrepare, OpSQLStmtClose:
+			untraced = true
+		default:
+			op = ic.fallbackOp
+		}
+	}
+
+	c := &call{opts: o, ctx: ctx, op: op, span: nullSpan{}, start: time.Now(), untraced: untraced}
+	c.setLabels(ctx)
+	c.startRecording()
+	if ic.Query != "" {
+		var args interface{}
+		if ic.Args != nil {
+			args = ic.Args
+		}
+		c.setQuery(ic.Query, args)
+		c.setStatement(ic.Statement())
+	}
+	if ic.originalQuery != "" {
+		c.setLabel("original_query", ic.originalQuery)
+	}
+	c.setAttempt(ic.attempt)
+	if ic.fallbackOp != "" {
+		c.setLabel("fallback", ic.fallbackOp)
+	}
+
+	return c
+}
+
+// startCall starts a child span for op of the span contained in ctx, for operations which are not driver calls
+// and therefore do not pass through the interceptor chain
+func (o opts) startCall(ctx context.Context, op string) *call {
+	c := &call{opts: o, ctx: ctx, op: op, span: nullSpan{}, start: time.Now()}
+	c.setLabels(ctx)
+	c.startSpan(ctx)
+
+	return c
+}
+
+// setLabels sets the labels every call starts with
+func (c *call) setLabels(ctx context.Context) {
+	for k, v := range c.Labels {
+		c.setLabel(k, v)
+	}
+	if ctx != nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			c.setLabel("deadline_remaining", time.Until(deadline).String())
+		}
+	}
+	c.conn.setLabels(c)
+}
+
+// startSpan starts the span of the call, labeled with the labels set so far
+func (c *call) startSpan(ctx context.Context) {
+	c.span = c.GetSpan(ctx).NewChild(c.op)
+	c.span.SetLabel("component", "database/sql")
+	for i := 0; i+1 < len(c.keyvals); i += 2 {
+		c.span.SetLabel(c.keyvals[i].(string), c.keyvals[i+1].(string))
+	}
+}
+
+// setLabel sets a label on the span and adds it to the logged keyvals
+func (c *call) setLabel(k, v string) {
+	if c == nil {
+		return
+	}
+
+	c.span.SetLabel(k, v)
+	c.keyvals = append(c.keyvals, k, v)
+}
+
+// replaceLabel sets a label on the span and replaces its value in the logged keyvals, or adds it
+func (c *call) replaceLabel(k, v string) {
+	for i := 0; i+1 < len(c.keyvals); i += 2 {
+		if c.keyvals[i] == k {
+			c.span.SetLabel(k, v)
+			c.keyvals[i+1] = v
+			return
+		}
+	}
+
+	c.setLabel(k, v)
+}
+
+// setQuery labels the call with the query and, unless omitted or nil, its arguments
+func (c *call) setQuery(query string, args interface{}) {
+	c.query = query
+	c.replaceLabel("query", query)
+	if args != nil && !c.OmitArgs {
+		c.replaceLabel("args", formatArgs(args))
+	}
+
+	if c.recording != nil {
+		c.recording.call.Query = query
+		c.recording.call.Args = recordArgs(args)
+	}
+}
+
+// setStatement labels the call with the operation and tables of its statement, if known
+func (c *call) setStatement(s sqlclass.Statement) {
+	if s.Operation != "" {
+		c.replaceLabel("db.operation", s.Operation)
+	}
+	if len(s.Tables) > 0 {
+		c.replaceLabel("db.sql.table", s.Table())
+	}
+}
+
+// refreshQuery relabels the call with the query of ic if an interceptor changed it, the query it was labeled with
+// becomes the original query unless the query was already rewritten
+func (c *call) refreshQuery(ic *Call) {
+	if c == nil || ic.Query == c.query {
+		return
+	}
+
+	if ic.originalQuery == "" {
+		ic.originalQuery = c.query
+		c.setLabel("original_query", ic.originalQuery)
+	}
+	var args interface{}
+	if ic.Args != nil {
+		args = ic.Args
+	}
+	c.setQuery(ic.Query, args)
+	c.setStatement(ic.Statement())
+}
+
+// finish records err as the outcome of a call started with startCall and finishes its span
+func (c *call) finish(err error) {
+	duration := time.Since(c.start)
+	c.finishSpan(c.ctx, err)
+	c.log(c.ctx, err, duration)
+	c.observe(c.ctx, err, duration)
+}
+
+// outcome determines how err is reported
+func (c *call) outcome(ctx context.Context, err error) outcome {
+	if c.isIgnoredError(c.op, err) {
+		return outcome{expected: true}
+	}
+
+	var out outcome
+	if out.status = contextStatus(ctx, err); out.status != "" && c.IgnoreContextErrors && !isTimeoutError(err) {
+		out.expected = true
+		return out
+	}
+	out.category = c.classifyError(err)
+
+	return out
+}
+
+// finishSpan finishes the span of the call, marking it as failed unless err is expected
+func (c *call) finishSpan(ctx context.Context, err error) {
+	out := c.outcome(ctx, err)
+	if out.status != "" {
+		c.span.SetLabel("status", out.status)
+	}
+	if !out.expected {
+		if out.category != "" {
+			c.span.SetLabel("error_category", string(out.category))
+		}
+		c.span.SetError(err)
+	}
+	c.span.Finish()
+}
+
+// log logs the call, an expected err is logged as ignored_err rather than err
+func (c *call) log(ctx context.Context, err error, duration time.Duration) {
+	out := c.outcome(ctx, err)
+	keyvals := append([]interface{}(nil), c.keyvals...)
+	if out.status != "" {
+		keyvals = append(keyvals, "status", out.status)
+	}
+	if out.expected {
+		keyvals = append(keyvals, "ignored_err", err)
+		err = nil
+	}
+	keyvals = append(keyvals, "err", err, "duration", duration)
+	if out.category != "" {
+		keyvals = append(keyvals, "err_category", string(out.category))
+	}
+
+	c.Log(ctx, c.op, keyvals...)
+}
+
+// observe observes the duration of the call with the metrics sink
+func (c *call) observe(ctx context.Context, err error, duration time.Duration) {
+	out := c.outcome(ctx, err)
+	labels := c.metricLabels()
+	if out.status != "" {
+		labels["status"] = out.status
+	}
+	if out.category != "" && !out.expected {
+		labels["error_category"] = string(out.category)
+	}
+
+	c.Observe(ctx, c.op, duration.Seconds(), labels)
+}
+
+// contextStatus returns the status of a call that failed because its context was cancelled or its deadline exceeded.
+// Drivers do not always return the context error as is, so a failure while the context is done is attributed to it as well.
+func contextStatus(ctx context.Context, err error) string {
+	if err == nil {
+		return ""
+	}
+
+	for e := err; e != nil; e = unwrapError(e) {
+		if status := contextErrStatus(e); status != "" {
+			return status
+		}
+	}
+
+	if ctx == nil {
+		return ""
+	}
+
+	return contextErrStatus(ctx.Err())
+}
+
+func contextErrStatus(err error) string {
+	switch err {
+	case context.Canceled:
+		return "cancelled"
+	case context.DeadlineExceeded:
+		return "deadline_exceeded"
+	default:
+		return ""
+	}
+}
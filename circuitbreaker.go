@@ -0,0 +1,258 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState string
+
+// The possible circuit states, used as the value of the circuit_breaker label
+const (
+	// CircuitClosed lets every call through, counting their failures
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen fails every call fast until the cooldown has passed
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen lets a single probe call through, which closes the circuit if it succeeds and opens it again if it fails
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// CircuitOpenError is returned for calls failed fast, without reaching the database, because the circuit is open
+type CircuitOpenError struct {
+	Op string
+	// Until is when the circuit lets a probe call through again, it is zero while a probe call is in flight
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	if e.Until.IsZero() {
+		return "instrumentedsql: " + e.Op + " rejected, circuit breaker is half-open"
+	}
+
+	return "instrumentedsql: " + e.Op + " rejected, circuit breaker is open until " + e.Until.Format(time.RFC3339)
+}
+
+// CircuitStatus is a snapshot of the state of a CircuitBreaker
+type CircuitStatus struct {
+	State CircuitState
+	// Since is when the circuit entered its state
+	Since time.Time
+	// Until is when an open circuit lets a probe call through, it is zero unless the circuit is open
+	Until time.Time
+	// Calls and Failures are counted in the current window, while the circuit is closed
+	Calls    int
+	Failures int
+	// Trips is how many times the circuit opened
+	Trips int
+}
+
+// CircuitBreaker sheds the load on a database which is unreachable or unresponsive, such as while it fails over.
+// It counts the calls connecting, preparing, executing and querying through the wrapped drivers it is passed to,
+// and opens once enough of them fail with a connection error or a timeout, failing new calls fast with a
+// CircuitOpenError instead of letting them wait on dead connections. Once the cooldown has passed, a single probe
+// call is let through to decide whether to close the circuit again. Use WithCircuitBreaker to enable it.
+//
+// State changes are logged under OpSQLCircuitBreaker, and guarded calls are labeled with the circuit_breaker state.
+type CircuitBreaker struct {
+	failureRatio float64
+	minCalls     int
+	window       time.Duration
+	cooldown     time.Duration
+
+	mu          sync.Mutex
+	state       CircuitState
+	since       time.Time
+	windowStart time.Time
+	calls       int
+	failures    int
+	trips       int
+	probing     bool
+}
+
+// circuitCall is a call let through by a CircuitBreaker, whose outcome is to be reported once it returns
+type circuitCall struct {
+	breaker *CircuitBreaker
+	opts    opts
+	ctx     context.Context
+	probe   bool
+	once    sync.Once
+}
+
+// NewCircuitBreaker returns a CircuitBreaker which opens once at least failureRatio of the calls made within window
+// fail, provided there were at least minCalls of them, and stays open for cooldown
+func NewCircuitBreaker(failureRatio float64, minCalls int, window, cooldown time.Duration) *CircuitBreaker {
+	now := time.Now()
+	return &CircuitBreaker{
+		failureRatio: failureRatio,
+		minCalls:     minCalls,
+		window:       window,
+		cooldown:     cooldown,
+		state:        CircuitClosed,
+		since:        now,
+		windowStart:  now,
+	}
+}
+
+// Status returns the current state of the circuit and its counters
+func (b *CircuitBreaker) Status() CircuitStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := CircuitStatus{
+		State:    b.state,
+		Since:    b.since,
+		Calls:    b.calls,
+		Failures: b.failures,
+		Trips:    b.trips,
+	}
+	if b.state == CircuitOpen {
+		status.Until = b.since.Add(b.cooldown)
+	}
+
+	return status
+}
+
+// Reset closes the circuit and forgets the calls counted so far
+func (b *CircuitBreaker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.setState(CircuitClosed, time.Now())
+	b.probing = false
+}
+
+// enterCircuit returns a CircuitOpenError if the circuit breaker fails call fast, labeling call with its state.
+// The outcome of a call let through must be reported with done once it returns.
+func (o opts) enterCircuit(ctx context.Context, call *Call) (*circuitCall, error) {
+	b := o.CircuitBreaker
+	if b == nil {
+		return nil, nil
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	previous := b.state
+	if b.state == CircuitOpen && now.Sub(b.since) >= b.cooldown {
+		b.setState(CircuitHalfOpen, now)
+	}
+	state, since := b.state, b.since
+	probe := false
+	switch {
+	case state == CircuitHalfOpen && !b.probing:
+		b.probing, probe = true, true
+	case state == CircuitClosed && now.Sub(b.windowStart) > b.window:
+		b.windowStart, b.calls, b.failures = now, 0, 0
+	}
+	b.mu.Unlock()
+
+	if state != previous {
+		o.logCircuit(ctx, previous, b.Status())
+	}
+	call.call.setLabel("circuit_breaker", string(state))
+
+	if state != CircuitClosed && !probe {
+		var until time.Time
+		if state == CircuitOpen {
+			until = since.Add(b.cooldown)
+		}
+		return nil, &CircuitOpenError{Op: call.Op, Until: until}
+	}
+
+	return &circuitCall{breaker: b, opts: o, ctx: ctx, probe: probe}, nil
+}
+
+// done reports the outcome of the call to the circuit breaker, at most once
+func (c *circuitCall) done(err error) {
+	if c == nil {
+		return
+	}
+
+	c.once.Do(func() {
+		b := c.breaker
+		failed := c.opts.isCircuitFailure(err)
+		// Canceled and skipped calls tell nothing about the database, the next call probes it in their stead
+		inconclusive := err == driver.ErrSkip || isCanceled(err)
+
+		b.mu.Lock()
+		now := time.Now()
+		previous := b.state
+		switch {
+		case c.probe:
+			b.probing = false
+			if failed {
+				b.trips++
+				b.setState(CircuitOpen, now)
+			} else if !inconclusive {
+				b.setState(CircuitClosed, now)
+			}
+		case b.state == CircuitClosed && !inconclusive:
+			b.calls++
+			if failed {
+				b.failures++
+			}
+			if failed && b.calls >= b.minCalls && float64(b.failures) >= b.failureRatio*float64(b.calls) {
+				b.trips++
+				b.setState(CircuitOpen, now)
+			}
+		}
+		state := b.state
+		b.mu.Unlock()
+
+		if state != previous {
+			c.opts.logCircuit(c.ctx, previous, b.Status())
+		}
+	})
+}
+
+// setState moves the circuit to state, resetting its counters
+func (b *CircuitBreaker) setState(state CircuitState, now time.Time) {
+	b.state, b.since = state, now
+	b.windowStart, b.calls, b.failures = now, 0, 0
+}
+
+// isCircuitFailure reports whether err counts as a failure of the database towards opening the circuit:
+// connection errors and timeouts do, save for calls canceled by their caller
+func (o opts) isCircuitFailure(err error) bool {
+	if err == nil || isCanceled(err) {
+		return false
+	}
+
+	switch o.classifyError(err) {
+	case ErrorCategoryConnectionLost, ErrorCategoryTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// logCircuit logs a change of the state of the circuit
+func (o opts) logCircuit(ctx context.Context, previous CircuitState, status CircuitStatus) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	keyvals := []interface{}{
+		"state", string(status.State),
+		"previous_state", string(previous),
+		"trips", strconv.Itoa(status.Trips),
+	}
+	if status.State == CircuitOpen {
+		keyvals = append(keyvals, "until", status.Until.Format(time.RFC3339Nano))
+	}
+	o.Log(ctx, OpSQLCircuitBreaker, keyvals...)
+}
+
+// isCanceled reports whether err is, or wraps, context.Canceled
+func isCanceled(err error) bool {
+	for ; err != nil; err = unwrapError(err) {
+		if err == context.Canceled {
+			return true
+		}
+	}
+
+	return false
+}
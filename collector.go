@@ -0,0 +1,109 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type statsCollectorKey struct{}
+
+// RequestStats summarizes the calls made through wrapped drivers with a context returned by WithStatsCollector
+type RequestStats struct {
+	// Queries is the number of statements executed or queried, whether on connections or prepared statements
+	Queries int
+	// Duration is the time spent in calls to the wrapped drivers, queries, prepares, transactions and reading rows included
+	Duration     time.Duration
+	RowsRead     int64
+	RowsAffected int64
+	// Transactions is the number of transactions begun
+	Transactions int
+	// Errors is the number of calls which failed, expected errors such as driver.ErrSkip excluded
+	Errors int
+}
+
+// String summarizes the stats, as in "37 queries in 412ms"
+func (s RequestStats) String() string {
+	return fmt.Sprintf("%d queries in %s", s.Queries, s.Duration.Round(time.Millisecond))
+}
+
+// Labels returns the stats as labels, for instance to set them on the root span of a request
+func (s RequestStats) Labels() map[string]string {
+	return map[string]string{
+		"sql.queries":       strconv.Itoa(s.Queries),
+		"sql.duration":      s.Duration.String(),
+		"sql.rows_read":     strconv.FormatInt(s.RowsRead, 10),
+		"sql.rows_affected": strconv.FormatInt(s.RowsAffected, 10),
+		"sql.transactions":  strconv.Itoa(s.Transactions),
+		"sql.errors":        strconv.Itoa(s.Errors),
+	}
+}
+
+type statsCollector struct {
+	mu    sync.Mutex
+	stats RequestStats
+}
+
+// WithStatsCollector returns a context collecting the stats of the calls made with it, or contexts derived from it,
+// through any wrapped driver. Read them with CollectedStats, typically once a request has been served.
+func WithStatsCollector(ctx context.Context) context.Context {
+	return context.WithValue(ctx, statsCollectorKey{}, &statsCollector{})
+}
+
+// CollectedStats returns the stats collected so far for ctx, which are zero if ctx was not returned by WithStatsCollector
+func CollectedStats(ctx context.Context) RequestStats {
+	c, ok := ctx.Value(statsCollectorKey{}).(*statsCollector)
+	if !ok {
+		return RequestStats{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// collectStats adds call, which took duration and failed with err, to the stats collected for ctx if any
+func (o opts) collectStats(ctx context.Context, call *Call, duration time.Duration, err error) {
+	if ctx == nil {
+		return
+	}
+	c, ok := ctx.Value(statsCollectorKey{}).(*statsCollector)
+	if !ok {
+		return
+	}
+
+	var rowsAffected int64
+	if res, ok := call.Result.(wrappedResult); ok && err == nil {
+		// Avoid tracing the call made to collect the stats
+		rowsAffected, _ = res.parent.RowsAffected()
+	}
+	failed := err != nil && !o.isIgnoredError(call.Op, err)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Duration += duration
+	c.stats.RowsAffected += rowsAffected
+	if failed {
+		c.stats.Errors++
+	}
+
+	switch call.Op {
+	case OpSQLConnExec, OpSQLConnQuery, OpSQLStmtExec, OpSQLStmtQuery:
+		if err != driver.ErrSkip {
+			c.stats.Queries++
+		}
+	case OpSQLRowsNext:
+		if err == nil {
+			c.stats.RowsRead++
+		}
+	case OpSQLTxBegin:
+		if err == nil {
+			c.stats.Transactions++
+		}
+	}
+}
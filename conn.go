@@ -4,11 +4,15 @@ import (
 	"context"
 	"database/sql/driver"
 	"time"
+
+	"github.com/luna-duclos/instrumentedsql/sqlclass"
 )
 
 type wrappedConn struct {
 	opts
 	parent driver.Conn
+	// stmts caches prepared statements when enabled through WithStmtCache
+	stmts *stmtCache
 }
 
 // Compile time validation that our types implement the expected interfaces
@@ -23,16 +27,27 @@ var (
 	_ driver.QueryerContext = wrappedConn{}
 )
 
+// use counts a statement issued on the connection, ending the wait for a connection it was handed out for
+func (c wrappedConn) use(ctx context.Context) {
+	endPoolWait(ctx)
+	c.conn.use()
+}
+
 func (c wrappedConn) Prepare(query string) (driver.Stmt, error) {
 	parent, err := c.parent.Prepare(query)
 	if err != nil {
 		return nil, err
 	}
 
-	return wrappedStmt{opts: c.opts, query: query, parent: parent}, nil
+	return wrappedStmt{opts: c.opts, parentConn: c.parent, query: query, statement: sqlclass.Classify(query), parent: parent, leak: c.track(nil, "stmt", query)}, nil
 }
 
 func (c wrappedConn) Close() error {
+	if c.stmts != nil {
+		c.stmts.close()
+	}
+	c.LeakDetector.connClosed(c.conn)
+
 	return c.parent.Close()
 }
 
@@ -41,61 +56,112 @@ func (c wrappedConn) Begin() (driver.Tx, error) {
 	if err != nil {
 		return nil, err
 	}
+	c.conn.beginTx()
 
 	return wrappedTx{opts: c.opts, parent: tx}, nil
 }
 
 func (c wrappedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (tx driver.Tx, err error) {
-	if !c.hasOpExcluded(OpSQLTxBegin) {
-		span := c.GetSpan(ctx).NewChild(OpSQLTxBegin)
-		span.SetLabel("component", "database/sql")
-		start := time.Now()
+	c.use(ctx)
+	attempt := c.startAttempt(ctx, OpSQLTxBegin, "")
+	defer func() {
+		attempt.done(err)
+	}()
+
+	call := &Call{Op: OpSQLTxBegin, attempt: attempt}
+	err = c.intercept(ctx, call, func(ctx context.Context) (err error) {
+		if err := c.guardTx(ctx, call, opts); err != nil {
+			return err
+		}
+
+		fault, err := c.injectFault(ctx, call.call, call.Op, "")
+		if err != nil {
+			return err
+		}
 		defer func() {
-			span.SetError(err)
-			span.Finish()
-			c.Log(ctx, OpSQLTxBegin, "err", err, "duration", time.Since(start))
+			if dropped, dropErr := fault.drop(tx, err); dropped {
+				tx, err = nil, dropErr
+			}
 		}()
-	}
 
-	if connBeginTx, ok := c.parent.(driver.ConnBeginTx); ok {
-		tx, err = connBeginTx.BeginTx(ctx, opts)
+		if connBeginTx, ok := c.parent.(driver.ConnBeginTx); ok {
+			tx, err = connBeginTx.BeginTx(ctx, opts)
+		} else {
+			tx, err = c.parent.Begin()
+		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		return wrappedTx{opts: c.opts, ctx: ctx, parent: tx}, nil
-	}
-
-	tx, err = c.parent.Begin()
+		tx = wrappedTx{opts: c.opts, ctx: ctx, parent: tx}
+		c.conn.beginTx()
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return wrappedTx{opts: c.opts, ctx: ctx, parent: tx}, nil
+	return tx, nil
 }
 
 func (c wrappedConn) PrepareContext(ctx context.Context, query string) (stmt driver.Stmt, err error) {
-	if !c.hasOpExcluded(OpSQLPrepare) {
-		span := c.GetSpan(ctx).NewChild(OpSQLPrepare)
-		span.SetLabel("component", "database/sql")
-		start := time.Now()
+	c.use(ctx)
+	attempt := c.startAttempt(ctx, OpSQLPrepare, query)
+	defer func() {
+		attempt.done(err)
+	}()
+
+	call := &Call{Op: OpSQLPrepare, Query: query, attempt: attempt, fallbackOp: attempt.fallbackOp}
+	c.rewriteQuery(ctx, call)
+	err = c.intercept(ctx, call, func(ctx context.Context) (err error) {
+		if err := c.guardQuery(ctx, call); err != nil {
+			return err
+		}
+		timeout, err := c.enforceTimeout(ctx, call)
+		if err != nil {
+			return err
+		}
 		defer func() {
-			span.SetError(err)
-			span.Finish()
-			logQuery(ctx, c.opts, OpSQLPrepare, query, err, nil, start)
+			err = timeout.check(err)
+			timeout.release()
+		}()
+		circuit, err := c.enterCircuit(ctx, call)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			circuit.done(err)
 		}()
-	}
 
-	if connPrepareCtx, ok := c.parent.(driver.ConnPrepareContext); ok {
-		stmt, err := connPrepareCtx.PrepareContext(ctx, query)
+		fault, err := c.injectFault(ctx, call.call, call.Op, call.Query)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		defer func() {
+			if dropped, dropErr := fault.drop(stmt, err); dropped {
+				stmt, err = nil, dropErr
+			}
+		}()
+
+		connPrepareCtx, ok := c.parent.(driver.ConnPrepareContext)
+		if !ok {
+			stmt, err = c.Prepare(call.Query)
+			return err
 		}
 
-		return wrappedStmt{opts: c.opts, ctx: ctx, query: query, parent: stmt}, nil
+		stmt, err = connPrepareCtx.PrepareContext(timeout.context(ctx), call.Query)
+		if err != nil {
+			return err
+		}
+
+		stmt = wrappedStmt{opts: c.opts, ctx: ctx, parentConn: c.parent, query: call.Query, originalQuery: call.originalQuery, statement: call.Statement(), parent: stmt, fallbackOp: attempt.fallbackOp, leak: c.track(ctx, "stmt", call.Query)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return c.Prepare(query)
+	return stmt, nil
 }
 
 func (c wrappedConn) Exec(query string, args []driver.Value) (driver.Result, error) {
@@ -112,33 +178,100 @@ func (c wrappedConn) Exec(query string, args []driver.Value) (driver.Result, err
 }
 
 func (c wrappedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (r driver.Result, err error) {
-	if !c.hasOpExcluded(OpSQLConnExec) {
-		span := c.GetSpan(ctx).NewChild(OpSQLConnExec)
-		span.SetLabel("component", "database/sql")
-		span.SetLabel("query", query)
-		if !c.OmitArgs {
-			span.SetLabel("args", formatArgs(args))
+	attempt := c.startAttempt(ctx, OpSQLConnExec, query)
+	defer func() {
+		attempt.done(err)
+	}()
+
+	// Quick skip path: If the wrapped connection implements neither ExecerContext nor Execer, database/sql will fall back to prepare and exec
+	_, hasExecerContext := c.parent.(driver.ExecerContext)
+	_, hasExecer := c.parent.(driver.Execer)
+	if !hasExecerContext && !hasExecer && c.stmts == nil {
+		return nil, driver.ErrSkip
+	}
+
+	c.use(ctx)
+	call := &Call{Op: OpSQLConnExec, Query: query, Args: args, attempt: attempt}
+	c.rewriteQuery(ctx, call)
+	var explain func()
+	err = c.intercept(ctx, call, func(ctx context.Context) (err error) {
+		if err := c.guardQuery(ctx, call); err != nil {
+			return err
+		}
+		timeout, err := c.enforceTimeout(ctx, call)
+		if err != nil {
+			return err
 		}
-		start := time.Now()
 		defer func() {
-			span.SetError(err)
-			span.Finish()
+			err = timeout.check(err)
+			timeout.release()
+		}()
+		ctx = timeout.context(ctx)
+		slot, err := c.acquireSlot(ctx, call)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			slot.release()
+		}()
+		circuit, err := c.enterCircuit(ctx, call)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			circuit.done(err)
+		}()
 
-			logQuery(ctx, c.opts, OpSQLConnExec, query, err, args, start)
+		fault, err := c.injectFault(ctx, call.call, call.Op, call.Query)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if dropped, dropErr := fault.drop(call.Result, err); dropped {
+				call.Result, err = nil, dropErr
+			}
 		}()
+
+		start := time.Now()
+		res, err := c.exec(ctx, call)
+		if err != nil {
+			return err
+		}
+		call.call.recordResult(res)
+		// The statement is explained once it returns, when the connection is free again
+		explain = c.explainSlow(ctx, c.parent, call, start)
+
+		call.Result = wrappedResult{opts: c.opts, ctx: ctx, parent: res}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if explain != nil {
+		explain()
 	}
 
-	if execContext, ok := c.parent.(driver.ExecerContext); ok {
-		res, err := execContext.ExecContext(ctx, query, args)
+	return call.Result, nil
+}
+
+// exec forwards an exec call to the wrapped connection, through the statement cache if enabled
+func (c wrappedConn) exec(ctx context.Context, call *Call) (driver.Result, error) {
+	if c.stmts != nil {
+		stmt, release, err := c.stmts.get(ctx, call.call, c.parent, call.Query)
 		if err != nil {
 			return nil, err
 		}
+		defer release()
 
-		return wrappedResult{opts: c.opts, ctx: ctx, parent: res}, nil
+		return execStmt(ctx, stmt, call.Args)
+	}
+
+	if execContext, ok := c.parent.(driver.ExecerContext); ok {
+		return execContext.ExecContext(ctx, call.Query, call.Args)
 	}
 
 	// Fallback implementation
-	dargs, err := namedValueToValue(args)
+	dargs, err := namedValueToValue(call.Args)
 	if err != nil {
 		return nil, err
 	}
@@ -147,24 +280,29 @@ func (c wrappedConn) ExecContext(ctx context.Context, query string, args []drive
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	default:
-		return c.Exec(query, dargs)
 	}
+
+	return c.parent.(driver.Execer).Exec(call.Query, dargs)
 }
 
 func (c wrappedConn) Ping(ctx context.Context) (err error) {
+	endPoolWait(ctx)
 	if pinger, ok := c.parent.(driver.Pinger); ok {
-		if !c.hasOpExcluded(OpSQLPing) {
-			span := c.GetSpan(ctx).NewChild(OpSQLPing)
-			span.SetLabel("component", "database/sql")
-			start := time.Now()
-			defer func() {
-				span.SetError(err)
-				span.Finish()
-				c.Log(ctx, OpSQLPing, "err", err, "duration", time.Since(start))
-			}()
-		}
+		attempt := c.startAttempt(ctx, OpSQLPing, "")
+		defer func() {
+			attempt.done(err)
+		}()
 
-		return pinger.Ping(ctx)
+		call := &Call{Op: OpSQLPing, attempt: attempt}
+		return c.intercept(ctx, call, func(ctx context.Context) error {
+			fault, err := c.injectFault(ctx, call.call, call.Op, "")
+			if err != nil {
+				return err
+			}
+
+			_, err = fault.drop(nil, pinger.Ping(ctx))
+			return err
+		})
 	}
 
 	c.Log(ctx, OpSQLDummyPing, "duration", time.Duration(0))
@@ -179,54 +317,124 @@ func (c wrappedConn) Query(query string, args []driver.Value) (driver.Rows, erro
 			return nil, err
 		}
 
-		return wrappedRows{opts: c.opts, parent: rows}, nil
+		return wrappedRows{opts: c.opts, parent: rows, leak: c.track(nil, "rows", query)}, nil
 	}
 
 	return nil, driver.ErrSkip
 }
 
 func (c wrappedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (rows driver.Rows, err error) {
+	attempt := c.startAttempt(ctx, OpSQLConnQuery, query)
+	defer func() {
+		attempt.done(err)
+	}()
+
 	// Quick skip path: If the wrapped connection implements neither QueryerContext nor Queryer, we have absolutely nothing to do
 	_, hasQueryerContext := c.parent.(driver.QueryerContext)
 	_, hasQueryer := c.parent.(driver.Queryer)
-	if !hasQueryerContext && !hasQueryer {
+	if !hasQueryerContext && !hasQueryer && c.stmts == nil {
 		return nil, driver.ErrSkip
 	}
 
-	if !c.hasOpExcluded(OpSQLConnQuery) {
-		span := c.GetSpan(ctx).NewChild(OpSQLConnQuery)
-		span.SetLabel("component", "database/sql")
-		span.SetLabel("query", query)
-		if !c.OmitArgs {
-			span.SetLabel("args", formatArgs(args))
+	c.use(ctx)
+	call := &Call{Op: OpSQLConnQuery, Query: query, Args: args, attempt: attempt}
+	c.rewriteQuery(ctx, call)
+	err = c.intercept(ctx, call, func(ctx context.Context) (err error) {
+		if err := c.guardQuery(ctx, call); err != nil {
+			return err
+		}
+		timeout, err := c.enforceTimeout(ctx, call)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// The rows release the timeout once closed
+			if err = timeout.check(err); err != nil {
+				timeout.release()
+			}
+		}()
+		ctx = timeout.context(ctx)
+		slot, err := c.acquireSlot(ctx, call)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// The rows release the slot once closed
+			if err != nil {
+				slot.release()
+			}
+		}()
+		circuit, err := c.enterCircuit(ctx, call)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			circuit.done(err)
+		}()
+
+		fault, err := c.injectFault(ctx, call.call, call.Op, call.Query)
+		if err != nil {
+			return err
 		}
-		start := time.Now()
 		defer func() {
-			span.SetError(err)
-			span.Finish()
-			logQuery(ctx, c.opts, OpSQLConnQuery, query, err, args, start)
+			if dropped, dropErr := fault.drop(call.Rows, err); dropped {
+				call.Rows, err = nil, dropErr
+			}
 		}()
+
+		start := time.Now()
+		rows, release, err := c.query(ctx, call)
+		if err != nil {
+			return err
+		}
+
+		// The query is explained once the rows are closed, when the connection is free again
+		explain := c.explainSlow(ctx, c.parent, call, start)
+		slot.claim()
+		call.Rows = wrappedRows{opts: c.opts, ctx: ctx, parent: rows, release: releaseAll(release, timeout.release, slot.release, explain), leak: c.track(ctx, "rows", call.Query), recording: call.call.recordRows(rows)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if queryerContext, ok := c.parent.(driver.QueryerContext); ok {
-		rows, err := queryerContext.QueryContext(ctx, query, args)
+	return call.Rows, nil
+}
+
+// query forwards a query call to the wrapped connection, through the statement cache if enabled.
+// The returned release function, if any, must be called once the rows are closed.
+func (c wrappedConn) query(ctx context.Context, call *Call) (driver.Rows, func(), error) {
+	if c.stmts != nil {
+		stmt, release, err := c.stmts.get(ctx, call.call, c.parent, call.Query)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+
+		rows, err := queryStmt(ctx, stmt, call.Args)
+		if err != nil {
+			release()
+			return nil, nil, err
 		}
 
-		return wrappedRows{opts: c.opts, ctx: ctx, parent: rows}, nil
+		return rows, release, nil
 	}
 
-	dargs, err := namedValueToValue(args)
+	if queryerContext, ok := c.parent.(driver.QueryerContext); ok {
+		rows, err := queryerContext.QueryContext(ctx, call.Query, call.Args)
+		return rows, nil, err
+	}
+
+	dargs, err := namedValueToValue(call.Args)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	select {
 	default:
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		return nil, nil, ctx.Err()
 	}
 
-	return c.Query(query, dargs)
-}
\ No newline at end of file
+	rows, err := c.parent.(driver.Queryer).Query(call.Query, dargs)
+	return rows, nil, err
+}
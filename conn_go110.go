@@ -10,6 +10,8 @@ import (
 var _ driver.SessionResetter = wrappedConn{}
 
 func (c wrappedConn) ResetSession(ctx context.Context) error {
+	endPoolWait(ctx)
+
 	conn, ok := c.parent.(driver.SessionResetter)
 	if !ok {
 		return nil
@@ -0,0 +1,888 @@
+// +build go1.10
+
+package instrumentedsql_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/luna-duclos/instrumentedsql"
+	"github.com/luna-duclos/instrumentedsql/instrumentedsqltest"
+	"github.com/luna-duclos/instrumentedsql/instrumentedsqltest/fakedriver"
+)
+
+// openDB opens a database through a wrapped fake driver, recording its spans and logs, it must be closed by the test
+func openDB(t *testing.T, features fakedriver.Features, opts ...instrumentedsql.Opt) (*sql.DB, *fakedriver.Driver, *instrumentedsqltest.Recorder) {
+	t.Helper()
+
+	rec := instrumentedsqltest.NewRecorder()
+	fake := fakedriver.New(features)
+	opts = append([]instrumentedsql.Opt{instrumentedsql.WithTracer(rec), instrumentedsql.WithLogger(rec)}, opts...)
+
+	connector, err := instrumentedsql.WrapDriver(fake, opts...).OpenConnector("fake")
+	if err != nil {
+		t.Fatalf("unexpected error from wrapped OpenConnector impl: %+v\n", err)
+	}
+
+	return sql.OpenDB(connector), fakedriver.Of(fake), rec
+}
+
+func TestConnQuery(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithOmitArgs())
+	defer db.Close()
+	fake.On(fakedriver.OpQuery, "SELECT name FROM users WHERE id = ?", fakedriver.Response{
+		Columns: []string{"name"},
+		Rows:    [][]driver.Value{{"luna"}},
+	})
+
+	var name string
+	if err := db.QueryRowContext(context.Background(), "SELECT name FROM users WHERE id = ?", 1).Scan(&name); err != nil {
+		t.Fatalf("unexpected error querying: %+v\n", err)
+	}
+	if name != "luna" {
+		t.Errorf("expected scripted row to be returned, got %q", name)
+	}
+
+	span := instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnQuery, "query", "SELECT name FROM users WHERE id = ?", "db.conn.uses", "1",
+		"db.operation", "SELECT", "db.sql.table", "users")
+	if span.Labels["db.conn.id"] == "" {
+		t.Error("expected the span to be labeled with the connection ID")
+	}
+	instrumentedsqltest.AssertNoLabel(t, rec, "args")
+	instrumentedsqltest.AssertNoLogKey(t, rec, "args")
+	instrumentedsqltest.AssertNoSpanErrors(t, rec)
+}
+
+func TestErrorCategory(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{})
+	defer db.Close()
+	fake.On(fakedriver.OpExec, "", fakedriver.Response{Err: context.DeadlineExceeded})
+
+	if _, err := db.ExecContext(context.Background(), "UPDATE users SET name = ?", "luna"); err == nil {
+		t.Fatal("expected scripted error to be returned")
+	}
+
+	span := instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "error_category", "timeout", "status", "deadline_exceeded")
+	instrumentedsqltest.AssertSpanError(t, span)
+	instrumentedsqltest.AssertLog(t, rec, instrumentedsql.OpSQLConnExec, "err_category", "timeout")
+}
+
+func TestIgnoreContextErrors(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithIgnoreContextErrors())
+	defer db.Close()
+	fake.On(fakedriver.OpExec, "", fakedriver.Response{Delay: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "UPDATE users SET name = ?", "luna"); err == nil {
+		t.Fatal("expected the call to time out")
+	}
+
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "status", "deadline_exceeded")
+	instrumentedsqltest.AssertNoSpanErrors(t, rec)
+}
+
+func TestBadConnRetry(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{})
+	defer db.Close()
+	fake.Once(fakedriver.OpExec, "", fakedriver.Response{Err: driver.ErrBadConn})
+	// Attempts are tied together by their context, unless it is shared as context.Background() is
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM users"); err != nil {
+		t.Fatalf("expected database/sql to retry, got %+v\n", err)
+	}
+
+	spans := rec.SpansNamed(instrumentedsql.OpSQLConnExec)
+	if len(spans) != 2 {
+		t.Fatalf("expected a span per attempt, got %d", len(spans))
+	}
+	if spans[0].Labels["error_category"] != string(instrumentedsql.ErrorCategoryConnectionLost) {
+		t.Errorf("expected the failed attempt to be reported, got labels %v", spans[0].Labels)
+	}
+	retry := instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "attempt", "2")
+	if len(retry.Errors) != 0 {
+		t.Errorf("expected the retry not to be marked as failed, got %v", retry.Errors)
+	}
+}
+
+func TestBadConnOutage(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{})
+	defer db.Close()
+	fake.On(fakedriver.OpExec, "", fakedriver.Response{Err: driver.ErrBadConn})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM users"); err != driver.ErrBadConn {
+		t.Fatalf("expected database/sql to give up with driver.ErrBadConn, got %v", err)
+	}
+
+	spans := rec.SpansNamed(instrumentedsql.OpSQLConnExec)
+	if len(spans) != 3 {
+		t.Fatalf("expected a span per attempt, got %d", len(spans))
+	}
+	for _, span := range spans {
+		if len(span.Errors) == 0 {
+			t.Errorf("expected attempt %q to be marked as failed", span.Labels["attempt"])
+		}
+	}
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "attempt", "3", "error_category", "connection_lost")
+}
+
+func TestBadConnConn(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{})
+	defer db.Close()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting a connection: %+v\n", err)
+	}
+	defer conn.Close()
+	fake.Once(fakedriver.OpExec, "", fakedriver.Response{Err: driver.ErrBadConn})
+
+	// database/sql does not retry the calls of a *sql.Conn, the failure must be reported
+	if _, err := conn.ExecContext(context.Background(), "DELETE FROM users"); err != driver.ErrBadConn {
+		t.Fatalf("expected driver.ErrBadConn, got %v", err)
+	}
+
+	span := instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "error_category", "connection_lost")
+	instrumentedsqltest.AssertSpanError(t, span)
+}
+
+func TestFallback(t *testing.T) {
+	db, _, rec := openDB(t, fakedriver.Features{NoExecer: true})
+	defer db.Close()
+
+	if _, err := db.ExecContext(context.Background(), "DELETE FROM users"); err != nil {
+		t.Fatalf("unexpected error executing: %+v\n", err)
+	}
+
+	instrumentedsqltest.AssertNoSpan(t, rec, instrumentedsql.OpSQLConnExec)
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLPrepare, "fallback", instrumentedsql.OpSQLConnExec)
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLStmtExec, "fallback", instrumentedsql.OpSQLConnExec, "db.operation", "DELETE", "db.sql.table", "users")
+}
+
+func TestCollapsedFallback(t *testing.T) {
+	db, _, rec := openDB(t, fakedriver.Features{NoExecer: true}, instrumentedsql.WithCollapsedFallback())
+	defer db.Close()
+
+	if _, err := db.ExecContext(context.Background(), "DELETE FROM users"); err != nil {
+		t.Fatalf("unexpected error executing: %+v\n", err)
+	}
+
+	instrumentedsqltest.AssertNoSpan(t, rec, instrumentedsql.OpSQLPrepare)
+	instrumentedsqltest.AssertNoSpan(t, rec, instrumentedsql.OpSQLStmtExec)
+	instrumentedsqltest.AssertNoSpan(t, rec, instrumentedsql.OpSQLStmtClose)
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "fallback", instrumentedsql.OpSQLConnExec)
+	instrumentedsqltest.AssertLog(t, rec, instrumentedsql.OpSQLPrepare, "query", "DELETE FROM users")
+}
+
+func TestPoolWait(t *testing.T) {
+	sqlDB, _, rec := openDB(t, fakedriver.Features{})
+	defer sqlDB.Close()
+	db, err := instrumentedsql.NewDB(sqlDB)
+	if err != nil {
+		t.Fatalf("unexpected error wrapping the database: %+v\n", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	held, err := sqlDB.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error taking the connection: %+v\n", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		held.Close()
+	}()
+
+	if _, err := db.ExecContext(context.Background(), "UPDATE users SET name = ?", "luna"); err != nil {
+		t.Fatalf("unexpected error executing: %+v\n", err)
+	}
+
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLPoolWait)
+	line := instrumentedsqltest.AssertLog(t, rec, instrumentedsql.OpSQLPoolWait)
+	if duration, _ := line.Value("duration"); duration.(time.Duration) < 50*time.Millisecond {
+		t.Errorf("expected the wait to last until the connection was released, got %v", duration)
+	}
+	instrumentedsqltest.AssertNoSpanErrors(t, rec)
+
+	// A wait which does not end before the context is done fails with it
+	held, err = sqlDB.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error taking the connection: %+v\n", err)
+	}
+	defer held.Close()
+	rec.Reset()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var name string
+	if err := db.QueryRowContext(ctx, "SELECT name FROM users").Scan(&name); err == nil {
+		t.Fatal("expected the wait for a connection to time out")
+	}
+	span := instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLPoolWait)
+	instrumentedsqltest.AssertSpanError(t, span)
+}
+
+func TestStmtCache(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithStmtCache(1))
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for _, query := range []string{"DELETE FROM users", "DELETE FROM users", "DELETE FROM groups"} {
+		if _, err := db.ExecContext(context.Background(), query); err != nil {
+			t.Fatalf("unexpected error executing: %+v\n", err)
+		}
+	}
+
+	if prepares := fake.CallsOf(fakedriver.OpPrepare); len(prepares) != 2 {
+		t.Errorf("expected a prepare per distinct query, got %d", len(prepares))
+	}
+	if closes := fake.CallsOf(fakedriver.OpStmtClose); len(closes) != 1 {
+		t.Errorf("expected the evicted statement to be closed, got %d closes", len(closes))
+	}
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "query", "DELETE FROM users", "stmt_cache", "hit")
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "query", "DELETE FROM groups", "stmt_cache", "miss", "stmt_cache_evictions", "1")
+}
+
+func TestLeakDetector(t *testing.T) {
+	detector := instrumentedsql.NewLeakDetector(time.Hour)
+	db, _, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithLeakDetector(detector))
+	defer db.Close()
+
+	rows, err := db.QueryContext(context.Background(), "SELECT 1")
+	if err != nil {
+		t.Fatalf("unexpected error querying: %+v\n", err)
+	}
+	if open := detector.Open(); len(open) != 1 || open[0].Kind != "rows" {
+		t.Errorf("expected the rows to be tracked, got %v", open)
+	}
+
+	rows.Close()
+	if open := detector.Open(); len(open) != 0 {
+		t.Errorf("expected no open handles once the rows are closed, got %v", open)
+	}
+	if leaks := detector.Leaks(); len(leaks) != 0 {
+		t.Errorf("expected no leaks, got %v", leaks)
+	}
+
+	stmt, err := db.PrepareContext(context.Background(), "SELECT 2")
+	if err != nil {
+		t.Fatalf("unexpected error preparing: %+v\n", err)
+	}
+	defer stmt.Close()
+	db.Close()
+
+	if leaks := detector.Leaks(); len(leaks) != 0 {
+		t.Errorf("expected database/sql to close statements before their connection, got %v", leaks)
+	}
+	instrumentedsqltest.AssertNoSpanErrors(t, rec)
+}
+
+func TestLeakDetectorTimeout(t *testing.T) {
+	detector := instrumentedsql.NewLeakDetector(10 * time.Millisecond)
+	db, _, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithLeakDetector(detector))
+	defer db.Close()
+
+	rows, err := db.QueryContext(context.Background(), "SELECT 1")
+	if err != nil {
+		t.Fatalf("unexpected error querying: %+v\n", err)
+	}
+	defer rows.Close()
+
+	for deadline := time.Now().Add(time.Second); len(detector.Leaks()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if leaks := detector.Leaks(); len(leaks) != 1 || leaks[0].Reason != instrumentedsql.LeakReasonTimeout {
+		t.Fatalf("expected the rows to be reported as leaked, got %v", leaks)
+	}
+	if open := detector.Open(); len(open) != 0 {
+		t.Errorf("expected the leaked rows to no longer be tracked, got %v", open)
+	}
+	instrumentedsqltest.AssertLog(t, rec, instrumentedsql.OpSQLLeak, "kind", "rows", "reason", instrumentedsql.LeakReasonTimeout)
+}
+
+func TestLegacyDriver(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{NoContext: true, NoConnector: true})
+	defer db.Close()
+	fake.On(fakedriver.OpQuery, "", fakedriver.Response{Columns: []string{"n"}, Rows: [][]driver.Value{{int64(1)}, {int64(2)}}})
+
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error beginning: %+v\n", err)
+	}
+
+	rows, err := tx.QueryContext(context.Background(), "SELECT n FROM numbers")
+	if err != nil {
+		t.Fatalf("unexpected error querying: %+v\n", err)
+	}
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	if err := rows.Close(); err != nil || count != 2 {
+		t.Errorf("expected both scripted rows, got %d and %v", count, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("unexpected error committing: %+v\n", err)
+	}
+
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLTxBegin)
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnQuery, "query", "SELECT n FROM numbers")
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLRowsNext)
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLTxCommit)
+	instrumentedsqltest.AssertNoSpanErrors(t, rec)
+}
+
+func TestFaultInjection(t *testing.T) {
+	injector := instrumentedsql.NewFaultRules(instrumentedsql.FaultRule{
+		Ops:   []string{instrumentedsql.OpSQLConnExec},
+		Query: regexp.MustCompile(`^DELETE`),
+		Fault: instrumentedsql.Fault{Err: errors.New("injected")},
+	})
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithFaultInjector(injector))
+	defer db.Close()
+
+	if _, err := db.ExecContext(context.Background(), "DELETE FROM users"); err == nil || err.Error() != "injected" {
+		t.Fatalf("expected the injected error, got %v", err)
+	}
+	if _, err := db.ExecContext(context.Background(), "UPDATE users SET name = ?", "luna"); err != nil {
+		t.Fatalf("expected calls not matching the rule to succeed, got %+v\n", err)
+	}
+
+	if execs := fake.CallsOf(fakedriver.OpExec); len(execs) != 1 {
+		t.Errorf("expected the failed call not to reach the driver, got %d calls", len(execs))
+	}
+	span := instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "query", "DELETE FROM users", "fault", "error")
+	instrumentedsqltest.AssertSpanError(t, span)
+}
+
+func TestInterceptor(t *testing.T) {
+	var ops []string
+	interceptor := func(ctx context.Context, call *instrumentedsql.Call, next func(ctx context.Context) error) error {
+		ops = append(ops, call.Op)
+		if call.Op == instrumentedsql.OpSQLConnExec {
+			call.SetLabel("tenant", "acme")
+			call.Query += " /* app=test */"
+		}
+
+		err := next(ctx)
+		if call.Op == instrumentedsql.OpSQLConnExec && call.Result == nil {
+			t.Error("expected the result to be set once the call returns")
+		}
+		return err
+	}
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithInterceptor(interceptor), instrumentedsql.WithOpsExcluded(instrumentedsql.OpSQLConnectorConnect))
+	defer db.Close()
+
+	if _, err := db.ExecContext(context.Background(), "DELETE FROM users"); err != nil {
+		t.Fatalf("unexpected error executing: %+v\n", err)
+	}
+
+	if len(ops) != 2 || ops[0] != instrumentedsql.OpSQLConnectorConnect || ops[1] != instrumentedsql.OpSQLConnExec {
+		t.Errorf("expected interceptors to see excluded ops too, got %v", ops)
+	}
+	if execs := fake.CallsOf(fakedriver.OpExec); len(execs) != 1 || execs[0].Query != "DELETE FROM users /* app=test */" {
+		t.Errorf("expected the query changed by the interceptor to reach the driver, got %v", execs)
+	}
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "tenant", "acme", "query", "DELETE FROM users /* app=test */", "original_query", "DELETE FROM users")
+	instrumentedsqltest.AssertLog(t, rec, instrumentedsql.OpSQLConnExec, "tenant", "acme", "query", "DELETE FROM users /* app=test */", "original_query", "DELETE FROM users")
+}
+
+func TestInterceptorChain(t *testing.T) {
+	failing := func(ctx context.Context, call *instrumentedsql.Call, next func(ctx context.Context) error) error {
+		if call.Op == instrumentedsql.OpSQLPing {
+			return errors.New("refused")
+		}
+		return next(ctx)
+	}
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithInterceptors(instrumentedsql.LoggingInterceptor, failing, instrumentedsql.TracingInterceptor))
+	defer db.Close()
+
+	if err := db.PingContext(context.Background()); err == nil || err.Error() != "refused" {
+		t.Fatalf("expected the interceptor to fail the call, got %v", err)
+	}
+
+	if calls := fake.CallsOf(fakedriver.OpPing); len(calls) != 0 {
+		t.Errorf("expected the call not to reach the driver, got %d calls", len(calls))
+	}
+	instrumentedsqltest.AssertNoSpan(t, rec, instrumentedsql.OpSQLPing)
+	instrumentedsqltest.AssertLog(t, rec, instrumentedsql.OpSQLPing, "err", "refused")
+}
+
+func TestQueryRewriter(t *testing.T) {
+	rewriter := func(ctx context.Context, op, query string) string {
+		return query + " /* app=test */"
+	}
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithQueryRewriter(rewriter))
+	defer db.Close()
+
+	stmt, err := db.PrepareContext(context.Background(), "DELETE FROM users")
+	if err != nil {
+		t.Fatalf("unexpected error preparing: %+v\n", err)
+	}
+	defer stmt.Close()
+	if _, err := stmt.ExecContext(context.Background()); err != nil {
+		t.Fatalf("unexpected error executing: %+v\n", err)
+	}
+
+	if prepares := fake.CallsOf(fakedriver.OpPrepare); len(prepares) != 1 || prepares[0].Query != "DELETE FROM users /* app=test */" {
+		t.Errorf("expected the rewritten query to be prepared, got %v", prepares)
+	}
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLPrepare, "query", "DELETE FROM users /* app=test */", "original_query", "DELETE FROM users")
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLStmtExec, "query", "DELETE FROM users /* app=test */", "original_query", "DELETE FROM users")
+}
+
+func TestReadOnly(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{})
+	defer db.Close()
+	ctx := instrumentedsql.ReadOnly(context.Background())
+
+	if _, err := db.QueryContext(ctx, "SELECT name FROM users"); err != nil {
+		t.Fatalf("expected reads to be allowed, got %+v\n", err)
+	}
+	_, err := db.ExecContext(ctx, "DELETE FROM users")
+	if _, ok := err.(*instrumentedsql.ReadOnlyError); !ok {
+		t.Fatalf("expected a ReadOnlyError, got %v", err)
+	}
+	if _, err := db.BeginTx(ctx, nil); err == nil {
+		t.Fatal("expected a transaction which is not read-only to be rejected")
+	}
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("expected read-only transactions to be allowed, got %+v\n", err)
+	}
+	tx.Rollback()
+
+	if execs := fake.CallsOf(fakedriver.OpExec); len(execs) != 0 {
+		t.Errorf("expected the write not to reach the driver, got %v", execs)
+	}
+	span := instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "query", "DELETE FROM users", "error_category", "permission_denied")
+	instrumentedsqltest.AssertSpanError(t, span)
+}
+
+func TestReadOnlyGuard(t *testing.T) {
+	db, fake, _ := openDB(t, fakedriver.Features{}, instrumentedsql.WithReadOnly())
+	defer db.Close()
+
+	for _, query := range []string{
+		"EXPLAIN ANALYZE DELETE FROM users",
+		"EXPLAIN (ANALYZE, BUFFERS) UPDATE users SET name = 'x'",
+		"SELECT * INTO backup FROM users",
+		"SET GLOBAL read_only = 0",
+		"SET SESSION CHARACTERISTICS AS TRANSACTION READ WRITE",
+		"",
+		"SELECT 1; DELETE FROM users",
+		"SELECT data #>> '{a}' FROM t; DELETE FROM users",
+		"SELECT E'x\\'' ; DELETE FROM users",
+		"CALL refresh_users()",
+	} {
+		_, err := db.ExecContext(context.Background(), query)
+		if _, ok := err.(*instrumentedsql.ReadOnlyError); !ok {
+			t.Errorf("expected %q to be rejected with a ReadOnlyError, got %v", query, err)
+		}
+	}
+	if execs := fake.CallsOf(fakedriver.OpExec); len(execs) != 0 {
+		t.Errorf("expected the writes not to reach the driver, got %v", execs)
+	}
+
+	for _, query := range []string{
+		"EXPLAIN SELECT * FROM users",
+		"SELECT 1;",
+		"SET search_path TO app, public",
+		"SET LOCAL statement_timeout = 1000",
+		"SET TIME ZONE 'UTC'",
+	} {
+		if _, err := db.ExecContext(context.Background(), query); err != nil {
+			t.Errorf("expected %q to be allowed, got %+v", query, err)
+		}
+	}
+}
+
+func TestNPlusOneDetector(t *testing.T) {
+	detector := instrumentedsql.NewNPlusOneDetector(2, nil)
+	db, _, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithNPlusOneDetector(detector))
+	defer db.Close()
+	ctx, request := rec.StartSpan(context.Background(), "request")
+	ctx = instrumentedsql.WithNPlusOneGroup(ctx)
+
+	for id := 1; id <= 4; id++ {
+		if _, err := db.ExecContext(ctx, "UPDATE users SET active = true WHERE id = ?", id); err != nil {
+			t.Fatalf("unexpected error executing: %+v\n", err)
+		}
+		// Calls without a group, such as those of background jobs, are not counted
+		if _, err := db.ExecContext(context.Background(), "DELETE FROM sessions WHERE id = ?", id); err != nil {
+			t.Fatalf("unexpected error executing: %+v\n", err)
+		}
+	}
+	request.Finish()
+
+	logs := 0
+	for _, log := range rec.Logs() {
+		if log.Msg == instrumentedsql.OpSQLNPlusOne {
+			logs++
+		}
+	}
+	if logs != 1 {
+		t.Errorf("expected the statement to be reported once, got %d reports", logs)
+	}
+	instrumentedsqltest.AssertLog(t, rec, instrumentedsql.OpSQLNPlusOne, "query", "UPDATE users SET active = true WHERE id = ?", "count", "3", "arg_shapes", "{int64}")
+	instrumentedsqltest.AssertSpan(t, rec, "request", "n_plus_one", "UPDATE users SET active = true WHERE id = ?")
+}
+
+func TestStatsCollector(t *testing.T) {
+	db, fake, _ := openDB(t, fakedriver.Features{})
+	defer db.Close()
+	fake.On(fakedriver.OpQuery, "", fakedriver.Response{Columns: []string{"n"}, Rows: [][]driver.Value{{int64(1)}, {int64(2)}}})
+	fake.On(fakedriver.OpExec, "UPDATE users SET active = true", fakedriver.Response{RowsAffected: 3})
+	fake.On(fakedriver.OpExec, "DELETE FROM users", fakedriver.Response{Err: errors.New("boom")})
+	ctx := instrumentedsql.WithStatsCollector(context.Background())
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("unexpected error beginning: %+v\n", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET active = true"); err != nil {
+		t.Fatalf("unexpected error executing: %+v\n", err)
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT n FROM numbers")
+	if err != nil {
+		t.Fatalf("unexpected error querying: %+v\n", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM users"); err == nil {
+		t.Fatal("expected scripted error to be returned")
+	}
+	tx.Rollback()
+
+	stats := instrumentedsql.CollectedStats(ctx)
+	if stats.Queries != 3 || stats.RowsRead != 2 || stats.RowsAffected != 3 || stats.Transactions != 1 || stats.Errors != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.Duration <= 0 {
+		t.Error("expected the time spent in calls to be collected")
+	}
+	if stats := instrumentedsql.CollectedStats(context.Background()); stats != (instrumentedsql.RequestStats{}) {
+		t.Errorf("expected no stats without a collector, got %+v", stats)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithOpTimeouts(map[string]time.Duration{
+		instrumentedsql.OpSQLConnExec: 10 * time.Millisecond,
+	}), instrumentedsql.WithIgnoreContextErrors())
+	defer db.Close()
+	fake.On(fakedriver.OpExec, "", fakedriver.Response{Delay: time.Second})
+
+	_, err := db.ExecContext(context.Background(), "UPDATE users SET active = true")
+	timeoutErr, ok := err.(*instrumentedsql.TimeoutError)
+	if !ok || timeoutErr.Kind != instrumentedsql.TimeoutKindOp {
+		t.Fatalf("expected an op TimeoutError, got %v", err)
+	}
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "timeout_enforced", "op", "error_category", "timeout")
+
+	ctx := instrumentedsql.WithSQLBudget(context.Background(), 5*time.Millisecond)
+	_, err = db.ExecContext(ctx, "UPDATE users SET active = true")
+	if timeoutErr, ok := err.(*instrumentedsql.TimeoutError); !ok || timeoutErr.Kind != instrumentedsql.TimeoutKindBudget {
+		t.Fatalf("expected the call to exceed the budget, got %v", err)
+	}
+	if remaining, ok := instrumentedsql.SQLBudgetRemaining(ctx); !ok || remaining > 0 {
+		t.Errorf("expected the time taken to be deducted from the budget, %s remaining", remaining)
+	}
+	before := len(fake.CallsOf(fakedriver.OpExec))
+	_, err = db.ExecContext(ctx, "UPDATE users SET active = true")
+	if timeoutErr, ok := err.(*instrumentedsql.TimeoutError); !ok || timeoutErr.Kind != instrumentedsql.TimeoutKindBudget {
+		t.Fatalf("expected a budget TimeoutError, got %v", err)
+	}
+	if after := len(fake.CallsOf(fakedriver.OpExec)); after != before {
+		t.Error("expected the call to be rejected once the budget is spent")
+	}
+
+	// Enforced timeouts are failures even when context errors are ignored, they are not the caller's cancellation
+	for _, span := range rec.SpansNamed(instrumentedsql.OpSQLConnExec) {
+		instrumentedsqltest.AssertSpanError(t, span)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := instrumentedsql.NewCircuitBreaker(0.5, 3, time.Minute, 20*time.Millisecond)
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithCircuitBreaker(breaker))
+	defer db.Close()
+	fake.On(fakedriver.OpExec, "", fakedriver.Response{Err: io.ErrUnexpectedEOF})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := db.ExecContext(ctx, "UPDATE users SET active = true"); err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected the driver error, got %v", err)
+		}
+	}
+	if status := breaker.Status(); status.State != instrumentedsql.CircuitOpen || status.Trips != 1 {
+		t.Fatalf("expected the circuit to open, got %+v", status)
+	}
+	instrumentedsqltest.AssertLog(t, rec, instrumentedsql.OpSQLCircuitBreaker, "state", "open", "previous_state", "closed")
+
+	_, err := db.ExecContext(ctx, "UPDATE users SET active = true")
+	if _, ok := err.(*instrumentedsql.CircuitOpenError); !ok {
+		t.Fatalf("expected a CircuitOpenError, got %v", err)
+	}
+	if execs := fake.CallsOf(fakedriver.OpExec); len(execs) != 2 {
+		t.Errorf("expected the call to fail fast, got %d execs", len(execs))
+	}
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "circuit_breaker", "open", "error_category", "connection_lost")
+
+	time.Sleep(20 * time.Millisecond)
+	fake.Reset()
+	if _, err := db.ExecContext(ctx, "UPDATE users SET active = true"); err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+	if status := breaker.Status(); status.State != instrumentedsql.CircuitClosed {
+		t.Errorf("expected the probe to close the circuit, got %+v", status)
+	}
+	instrumentedsqltest.AssertLog(t, rec, instrumentedsql.OpSQLCircuitBreaker, "state", "closed", "previous_state", "half-open")
+}
+
+func TestMaxConcurrentQueries(t *testing.T) {
+	type classKey struct{}
+	db, fake, rec := openDB(t, fakedriver.Features{},
+		instrumentedsql.WithMaxConcurrentQueries(1),
+		instrumentedsql.WithQueryClasses(instrumentedsql.ClassByContextValue(classKey{}), map[string]int{"oltp": 2}),
+	)
+	defer db.Close()
+	fake.On(fakedriver.OpQuery, "", fakedriver.Response{Columns: []string{"n"}, Rows: [][]driver.Value{{int64(1)}}})
+	reports := context.WithValue(context.Background(), classKey{}, "reports")
+	oltp := context.WithValue(context.Background(), classKey{}, "oltp")
+
+	rows, err := db.QueryContext(reports, "SELECT count(*) FROM orders")
+	if err != nil {
+		t.Fatalf("unexpected error querying: %+v\n", err)
+	}
+	if _, err := db.ExecContext(oltp, "UPDATE users SET active = true"); err != nil {
+		t.Fatalf("expected other classes not to wait, got %+v\n", err)
+	}
+
+	ctx, cancel := context.WithTimeout(reports, 10*time.Millisecond)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "DELETE FROM reports"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the query to wait for the open rows, got %v", err)
+	}
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLLimiterWait, "limiter_class", "reports", "limiter_limit", "1")
+	if execs := fake.CallsOf(fakedriver.OpExec); len(execs) != 1 {
+		t.Errorf("expected the waiting query not to reach the driver, got %v", execs)
+	}
+
+	rows.Close()
+	if _, err := db.ExecContext(reports, "DELETE FROM reports"); err != nil {
+		t.Fatalf("expected the query to run once the rows are closed, got %+v\n", err)
+	}
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "query", "DELETE FROM reports", "limiter_class", "reports", "limiter_wait", "0s")
+}
+
+func TestMaxConcurrentQueriesPool(t *testing.T) {
+	type classKey struct{}
+	sqlDB, fake, rec := openDB(t, fakedriver.Features{},
+		instrumentedsql.WithQueryClasses(instrumentedsql.ClassByContextValue(classKey{}), map[string]int{"reports": 1}),
+	)
+	defer sqlDB.Close()
+	sqlDB.SetMaxOpenConns(3)
+	db, err := instrumentedsql.NewDB(sqlDB)
+	if err != nil {
+		t.Fatalf("unexpected error wrapping the database: %+v\n", err)
+	}
+	fake.On(fakedriver.OpQuery, "", fakedriver.Response{Columns: []string{"n"}, Rows: [][]driver.Value{{int64(1)}}})
+	reports := context.WithValue(context.Background(), classKey{}, "reports")
+
+	rows, err := db.QueryContext(reports, "SELECT count(*) FROM orders")
+	if err != nil {
+		t.Fatalf("unexpected error querying: %+v\n", err)
+	}
+	queued := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := db.ExecContext(reports, "DELETE FROM reports")
+			queued <- err
+		}()
+	}
+	for len(rec.SpansNamed(instrumentedsql.OpSQLLimiterWait)) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if inUse := db.Stats().InUse; inUse != 1 {
+		t.Errorf("expected queued queries not to hold a connection, %d are in use", inUse)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "UPDATE users SET active = true"); err != nil {
+		t.Fatalf("expected unlimited queries to get a connection, got %+v\n", err)
+	}
+
+	rows.Close()
+	for i := 0; i < 2; i++ {
+		if err := <-queued; err != nil {
+			t.Fatalf("expected queued queries to run once the rows are closed, got %+v\n", err)
+		}
+	}
+	span := instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec, "query", "DELETE FROM reports", "limiter_class", "reports")
+	if span.Labels["limiter_wait"] == "0s" {
+		t.Errorf("expected the query to be labeled with its wait, got %v", span.Labels)
+	}
+}
+
+func TestAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := instrumentedsql.NewJSONLinesAuditSink(&buf, 0)
+	db, fake, _ := openDB(t, fakedriver.Features{},
+		instrumentedsql.WithAuditSink(sink),
+		instrumentedsql.WithAuditFailures(),
+		instrumentedsql.WithOpsExcluded(instrumentedsql.OpSQLConnExec, instrumentedsql.OpSQLTxCommit),
+	)
+	defer db.Close()
+	fake.On(fakedriver.OpExec, "UPDATE users SET active = true WHERE id = ?", fakedriver.Response{RowsAffected: 1})
+	fake.On(fakedriver.OpExec, "DELETE FROM users", fakedriver.Response{Err: errors.New("boom")})
+	ctx := instrumentedsql.WithAuditActor(context.Background(), "alice")
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("unexpected error beginning: %+v\n", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET active = true WHERE id = ?", 42); err != nil {
+		t.Fatalf("unexpected error executing: %+v\n", err)
+	}
+	if _, err := tx.QueryContext(ctx, "SELECT name FROM users"); err != nil {
+		t.Fatalf("unexpected error querying: %+v\n", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("unexpected error committing: %+v\n", err)
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM users"); err == nil {
+		t.Fatal("expected the delete to fail")
+	}
+	if buf.Len() != 0 {
+		t.Error("expected the records to be buffered")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %+v\n", err)
+	}
+	var records []instrumentedsql.AuditRecord
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var record instrumentedsql.AuditRecord
+		if err := dec.Decode(&record); err != nil {
+			t.Fatalf("unexpected error decoding: %+v\n", err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected the update, the commit and the failed delete to be audited, got %+v", records)
+	}
+
+	update, commit, failed := records[0], records[1], records[2]
+	if update.Actor != "alice" || update.Operation != "UPDATE" || update.Tables[0] != "users" || update.TxID == "" ||
+		update.RowsAffected == nil || *update.RowsAffected != 1 || len(update.Args) != 1 || update.Args[0].Type != "int64" || update.Args[0].Value != nil {
+		t.Errorf("unexpected update record %+v", update)
+	}
+	if commit.Operation != "COMMIT" || commit.TxID != update.TxID {
+		t.Errorf("unexpected commit record %+v", commit)
+	}
+	if failed.Operation != "DELETE" || failed.Err != "boom" || failed.TxID != "" {
+		t.Errorf("unexpected failed record %+v", failed)
+	}
+}
+
+// failingAuditSink fails to write every record
+type failingAuditSink struct{}
+
+func (failingAuditSink) Write(ctx context.Context, record instrumentedsql.AuditRecord) error {
+	return errors.New("disk full")
+}
+
+func TestAuditSinkFailure(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithAuditSink(failingAuditSink{}))
+	defer db.Close()
+
+	if _, err := db.ExecContext(context.Background(), "DELETE FROM users"); err != nil {
+		t.Fatalf("expected the failure to write the record only to be logged, got %+v\n", err)
+	}
+	instrumentedsqltest.AssertLog(t, rec, instrumentedsql.OpSQLAudit, "op", instrumentedsql.OpSQLConnExec, "query", "DELETE FROM users")
+
+	required, _, _ := openDB(t, fakedriver.Features{}, instrumentedsql.WithAuditSink(failingAuditSink{}), instrumentedsql.WithAuditRequired())
+	defer required.Close()
+
+	tx, err := required.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error beginning: %+v\n", err)
+	}
+	_, err = tx.ExecContext(context.Background(), "DELETE FROM users")
+	if auditErr, ok := err.(*instrumentedsql.AuditError); !ok || auditErr.Err.Error() != "disk full" {
+		t.Fatalf("expected an AuditError, got %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("unexpected error rolling back: %+v\n", err)
+	}
+	if _, err := required.QueryContext(context.Background(), "SELECT name FROM users"); err != nil {
+		t.Fatalf("expected reads not to be audited, got %+v\n", err)
+	}
+	if execs := fake.CallsOf(fakedriver.OpExec); len(execs) != 1 {
+		t.Errorf("expected a single exec on the first database, got %v", execs)
+	}
+}
+
+func TestSlowQueryExplain(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithSlowQueryExplain(10*time.Millisecond, instrumentedsql.PostgresExplain, time.Minute))
+	defer db.Close()
+	fake.On(fakedriver.OpQuery, "EXPLAIN SELECT name FROM users WHERE id = ?", fakedriver.Response{Columns: []string{"QUERY PLAN"}, Rows: [][]driver.Value{{"Index Scan using users_pkey on users"}, {"  Index Cond: (id = $1)"}}})
+	fake.On(fakedriver.OpQuery, "", fakedriver.Response{Delay: 20 * time.Millisecond, Columns: []string{"name"}, Rows: [][]driver.Value{{"alice"}}})
+	fake.On(fakedriver.OpExec, "", fakedriver.Response{Delay: 20 * time.Millisecond})
+
+	rows, err := db.QueryContext(context.Background(), "SELECT name FROM users WHERE id = ?", 42)
+	if err != nil {
+		t.Fatalf("unexpected error querying: %+v\n", err)
+	}
+	if explains := rec.SpansNamed(instrumentedsql.OpSQLExplain); len(explains) != 0 {
+		t.Error("expected the query to be explained once its rows are closed")
+	}
+	rows.Close()
+	instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLExplain, "query", "SELECT name FROM users WHERE id = ?", "plan", "Index Scan using users_pkey on users\n  Index Cond: (id = $1)")
+
+	if _, err := db.ExecContext(context.Background(), "DELETE FROM users WHERE id = ?", 42); err != nil {
+		t.Fatalf("unexpected error executing: %+v\n", err)
+	}
+	if _, err := db.ExecContext(context.Background(), "CREATE INDEX users_name ON users (name)"); err != nil {
+		t.Fatalf("unexpected error executing: %+v\n", err)
+	}
+	if explains := rec.SpansNamed(instrumentedsql.OpSQLExplain); len(explains) != 1 {
+		t.Errorf("expected a single query to be explained per interval, got %d", len(explains))
+	}
+}
+
+func TestSlowExecExplain(t *testing.T) {
+	db, fake, rec := openDB(t, fakedriver.Features{}, instrumentedsql.WithSlowQueryExplain(10*time.Millisecond, instrumentedsql.PostgresExplain, time.Minute))
+	defer db.Close()
+	fake.On(fakedriver.OpQuery, "EXPLAIN DELETE FROM users WHERE id = ?", fakedriver.Response{Delay: 50 * time.Millisecond, Columns: []string{"QUERY PLAN"}, Rows: [][]driver.Value{{"Delete on users"}}})
+	fake.On(fakedriver.OpExec, "", fakedriver.Response{Delay: 20 * time.Millisecond})
+
+	if _, err := db.ExecContext(context.Background(), "DELETE FROM users WHERE id = ?", 42); err != nil {
+		t.Fatalf("unexpected error executing: %+v\n", err)
+	}
+
+	exec := instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLConnExec)
+	explain := instrumentedsqltest.AssertSpan(t, rec, instrumentedsql.OpSQLExplain, "plan", "Delete on users")
+	if explain.Started < exec.Finished {
+		t.Error("expected the statement to be explained once its call finished")
+	}
+	line := instrumentedsqltest.AssertLog(t, rec, instrumentedsql.OpSQLConnExec)
+	if duration, _ := line.Value("duration"); duration.(time.Duration) >= 50*time.Millisecond {
+		t.Errorf("expected the explain not to be timed as part of the statement, got %v", duration)
+	}
+}
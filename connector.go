@@ -5,7 +5,7 @@ package instrumentedsql
 import (
 	"context"
 	"database/sql/driver"
-	"time"
+	"io"
 )
 
 type wrappedConnector struct {
@@ -16,26 +16,61 @@ type wrappedConnector struct {
 
 var (
 	_ driver.Connector = wrappedConnector{}
+	_ io.Closer        = wrappedConnector{}
 )
 
 func (c wrappedConnector) Connect(ctx context.Context) (conn driver.Conn, err error) {
-	if !c.hasOpExcluded(OpSQLConnectorConnect) {
-		span := c.GetSpan(ctx).NewChild(OpSQLConnectorConnect)
-		span.SetLabel("component", "database/sql")
-		start := time.Now()
+	endPoolWait(ctx)
+
+	call := &Call{Op: OpSQLConnectorConnect}
+	err = c.intercept(ctx, call, func(ctx context.Context) (err error) {
+		circuit, err := c.enterCircuit(ctx, call)
+		if err != nil {
+			return err
+		}
 		defer func() {
-			span.SetError(err)
-			span.Finish()
-			c.Log(ctx, OpSQLConnectorConnect, "err", err, "duration", time.Since(start))
+			circuit.done(err)
 		}()
-	}
 
-	conn, err = c.parent.Connect(ctx)
+		fault, err := c.injectFault(ctx, call.call, call.Op, "")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if dropped, dropErr := fault.drop(conn, err); dropped {
+				conn, err = nil, dropErr
+			}
+		}()
+
+		conn, err = c.parent.Connect(ctx)
+		if err != nil {
+			return err
+		}
+
+		conn = newWrappedConn(ctx, c.driverRef.opts, conn)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return wrappedConn{opts: c.driverRef.opts, parent: conn}, nil
+	return conn, nil
+}
+
+// Close flushes the audit sink, if it buffers its writes, and closes the wrapped connector if it implements io.Closer.
+// database/sql closes the connector along with the DB as of go 1.17.
+func (c wrappedConnector) Close() error {
+	var err error
+	if flusher, ok := c.AuditSink.(auditFlusher); ok {
+		err = flusher.Flush()
+	}
+	if closer, ok := c.parent.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
 }
 
 func (c wrappedConnector) Driver() driver.Driver {
@@ -0,0 +1,125 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connCounter is used to hand out connection IDs that are unique within the process
+var connCounter uint64
+
+// ServerConnIDFunc fetches the identifier the database server uses for a newly opened connection,
+// such as the backend PID in Postgres. See also ServerConnIDQuery.
+type ServerConnIDFunc func(ctx context.Context, conn driver.Conn) (string, error)
+
+// connInfo identifies a connection and tracks how long and how much it has been used
+type connInfo struct {
+	// uses is accessed atomically and kept first for 64-bit alignment on 32-bit platforms
+	uses     uint64
+	id       uint64
+	serverID string
+	created  time.Time
+
+	// mu guards the transaction open on the connection, see beginTx
+	mu        sync.Mutex
+	txID      string
+	txAudited bool
+}
+
+// newWrappedConn wraps a connection freshly opened by the parent driver, assigning it an ID
+func newWrappedConn(ctx context.Context, o opts, parent driver.Conn) wrappedConn {
+	info := &connInfo{
+		id:      atomic.AddUint64(&connCounter, 1),
+		created: time.Now(),
+	}
+
+	if o.ServerConnID != nil {
+		serverID, err := o.ServerConnID(ctx, parent)
+		if err != nil {
+			o.Log(ctx, OpSQLConnServerID, "db.conn.id", strconv.FormatUint(info.id, 10), "err", err)
+		}
+		info.serverID = serverID
+	}
+
+	o.conn = info
+	c := wrappedConn{opts: o, parent: parent}
+	if o.StmtCacheSize > 0 {
+		c.stmts = newStmtCache(o.StmtCacheSize)
+	}
+
+	return c
+}
+
+// use counts a statement issued on the connection
+func (i *connInfo) use() {
+	if i == nil {
+		return
+	}
+
+	atomic.AddUint64(&i.uses, 1)
+}
+
+// setLabels labels the call with the identity, age and use count of the connection
+func (i *connInfo) setLabels(c *call) {
+	if i == nil {
+		return
+	}
+
+	c.setLabel("db.conn.id", strconv.FormatUint(i.id, 10))
+	if i.serverID != "" {
+		c.setLabel("db.conn.server_id", i.serverID)
+	}
+	c.setLabel("db.conn.age", time.Since(i.created).String())
+	c.setLabel("db.conn.uses", strconv.FormatUint(atomic.LoadUint64(&i.uses), 10))
+}
+
+// ServerConnIDQuery returns a ServerConnIDFunc running the passed query on the new connection and using
+// the first column of the first row as the server side ID, see PostgresServerConnID and MySQLServerConnID.
+// The wrapped driver must implement driver.QueryerContext or driver.Queryer.
+func ServerConnIDQuery(query string) ServerConnIDFunc {
+	return func(ctx context.Context, conn driver.Conn) (string, error) {
+		var rows driver.Rows
+		var err error
+		switch queryer := conn.(type) {
+		case driver.QueryerContext:
+			rows, err = queryer.QueryContext(ctx, query, nil)
+		case driver.Queryer:
+			rows, err = queryer.Query(query, nil)
+		default:
+			return "", driver.ErrSkip
+		}
+		if err != nil {
+			return "", err
+		}
+		defer rows.Close()
+
+		dest := make([]driver.Value, len(rows.Columns()))
+		if err := rows.Next(dest); err != nil {
+			if err == io.EOF {
+				return "", fmt.Errorf("instrumentedsql: %q returned no rows", query)
+			}
+			return "", err
+		}
+		if len(dest) == 0 {
+			return "", fmt.Errorf("instrumentedsql: %q returned no columns", query)
+		}
+
+		if b, ok := dest[0].([]byte); ok {
+			return string(b), nil
+		}
+		return fmt.Sprint(dest[0]), nil
+	}
+}
+
+var (
+	// PostgresServerConnID uses the backend PID as the server side ID of Postgres connections
+	PostgresServerConnID = ServerConnIDQuery("SELECT pg_backend_pid()")
+	// MySQLServerConnID uses the connection ID as the server side ID of MySQL connections
+	MySQLServerConnID = ServerConnIDQuery("SELECT CONNECTION_ID()")
+)
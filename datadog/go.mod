@@ -7,3 +7,6 @@ require (
 	github.com/luna-duclos/instrumentedsql v1.1.3
 	gopkg.in/DataDog/dd-trace-go.v1 v1.33.0
 )
+
+// The trace options use the sqlclass package, which is not in a tagged release yet
+replace github.com/luna-duclos/instrumentedsql => ../
@@ -5,13 +5,20 @@ import (
 	"database/sql/driver"
 
 	"github.com/luna-duclos/instrumentedsql"
+	"github.com/luna-duclos/instrumentedsql/sqlclass"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
+// tagDBSystem is the tag of the database management system, which is not defined by ext in all versions we support
+const tagDBSystem = "db.system"
+
 type trace struct {
-	traceOrphans bool
+	traceOrphans  bool
+	serviceName   string
+	queryResource bool
+	tags          map[string]interface{}
 }
 
 type span struct {
@@ -20,6 +27,7 @@ type span struct {
 	parent ddtrace.Span
 }
 
+// TraceOption is a functional option type for the tracer returned by NewTracer
 type TraceOption func(t *trace)
 
 // NewTracer returns a tracer which will fetch spans using datadog's SpanFromContext function.
@@ -42,6 +50,51 @@ func TraceOrphans(traceOrphans bool) TraceOption {
 	}
 }
 
+// WithServiceName sets the service of the spans, so that they show as a service of their own rather than under
+// that of their parent span
+func WithServiceName(name string) TraceOption {
+	return func(t *trace) {
+		t.serviceName = name
+	}
+}
+
+// WithQueryResource sets the resource of the spans to their query, normalized with sqlclass.Normalize so that
+// the executions of a statement share their resource. Spans without a query keep their op as resource.
+func WithQueryResource() TraceOption {
+	return func(t *trace) {
+		t.queryResource = true
+	}
+}
+
+// WithDBSystem sets the db.system tag of the spans to the database management system, such as postgresql or mysql
+func WithDBSystem(system string) TraceOption {
+	return withTag(tagDBSystem, system)
+}
+
+// WithDBInstance sets the db.instance tag of the spans to the name of the database
+func WithDBInstance(instance string) TraceOption {
+	return withTag(ext.DBInstance, instance)
+}
+
+// WithPeer sets the out.host and out.port tags of the spans to the address of the database server
+func WithPeer(host string, port int) TraceOption {
+	return func(t *trace) {
+		withTag(ext.TargetHost, host)(t)
+		withTag(ext.TargetPort, port)(t)
+	}
+}
+
+func withTag(k string, v interface{}) TraceOption {
+	return func(t *trace) {
+		tags := make(map[string]interface{}, len(t.tags)+1)
+		for key, value := range t.tags {
+			tags[key] = value
+		}
+		tags[k] = v
+		t.tags = tags
+	}
+}
+
 // GetSpan returns a span.
 func (t trace) GetSpan(ctx context.Context) instrumentedsql.Span {
 	ddSpan, ok := tracer.SpanFromContext(ctx)
@@ -60,24 +113,33 @@ func (s span) NewChild(name string) instrumentedsql.Span {
 		tracer.SpanType(ext.SpanTypeSQL),
 		tracer.Measured(),
 	}
+	if s.serviceName != "" {
+		opts = append(opts, tracer.ServiceName(s.serviceName))
+	}
+	for k, v := range s.tags {
+		opts = append(opts, tracer.Tag(k, v))
+	}
 	newSpan, ctx := tracer.StartSpanFromContext(s.ctx, name, opts...)
 	return span{parent: newSpan, ctx: ctx, trace: s.trace}
 }
 
-// SetLabel sets a tag on the span.
+// SetLabel sets a tag on the span, and its resource to the normalized query if enabled with WithQueryResource.
 func (s span) SetLabel(k, v string) {
 	if s.parent == nil {
 		return
 	}
 	s.parent.SetTag(k, v)
+	if k == "query" && s.queryResource {
+		s.parent.SetTag(ext.ResourceName, sqlclass.Normalize(v))
+	}
 }
 
-// SetError sets a tag with the error.
+// SetError marks the span as failed with the error, as tracer.WithError does when the span is finished.
 func (s span) SetError(err error) {
 	if err == nil || err == driver.ErrSkip || s.parent == nil {
 		return
 	}
-	s.parent.SetTag("err", err.Error())
+	s.parent.SetTag(ext.Error, err)
 }
 
 // Finish finishes the span.
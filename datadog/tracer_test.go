@@ -1,18 +1,78 @@
 package datadog
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"testing"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/luna-duclos/instrumentedsql"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
 // WrapDriverDatadog demonstrates how to call wrapDriver and register a new driver.
 // This example uses MySQL and datadog to illustrate this
 func ExampleWrapDriver_datadog() {
-	sql.Register("instrumented-mysql", instrumentedsql.WrapDriver(mysql.MySQLDriver{}, instrumentedsql.WithTracer(NewTracer())))
+	tracer := NewTracer(
+		WithServiceName("users-db"),
+		WithQueryResource(),
+		WithDBSystem("mysql"),
+		WithDBInstance("users"),
+		WithPeer("localhost", 3306),
+	)
+	sql.Register("instrumented-mysql", instrumentedsql.WrapDriver(mysql.MySQLDriver{}, instrumentedsql.WithTracer(tracer)))
 	db, err := sql.Open("instrumented-mysql", "connString")
 
 	// Proceed to handle connection errors and use the database as usual
 	_, _ = db, err
 }
+
+func TestTraceOptions(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	root := tracer.StartSpan("request")
+	ctx := tracer.ContextWithSpan(context.Background(), root)
+	tr := NewTracer(
+		WithServiceName("users-db"),
+		WithQueryResource(),
+		WithDBSystem("mysql"),
+		WithDBInstance("users"),
+		WithPeer("localhost", 3306),
+	)
+
+	err := errors.New("boom")
+	s := tr.GetSpan(ctx).NewChild(instrumentedsql.OpSQLConnQuery)
+	s.SetLabel("query", "SELECT name FROM users WHERE id = 42")
+	s.SetError(err)
+	s.Finish()
+	root.Finish()
+
+	spans := mt.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected the query and request spans to be finished, got %d", len(spans))
+	}
+	query := spans[0]
+	expected := map[string]interface{}{
+		ext.ServiceName:  "users-db",
+		ext.ResourceName: "SELECT name FROM users WHERE id = ?",
+		ext.SpanType:     ext.SpanTypeSQL,
+		"db.system":      "mysql",
+		ext.DBInstance:   "users",
+		ext.TargetHost:   "localhost",
+		ext.TargetPort:   3306,
+		ext.Error:        err,
+		"query":          "SELECT name FROM users WHERE id = 42",
+	}
+	for k, v := range expected {
+		if tag := query.Tag(k); tag != v {
+			t.Errorf("expected tag %s to be %v, got %v", k, v, tag)
+		}
+	}
+	if query.ParentID() != root.Context().SpanID() {
+		t.Error("expected the query span to be a child of the request span")
+	}
+}
@@ -0,0 +1,193 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+)
+
+// ErrNotWrapped is returned when a sql.DB was not opened through a WrappedDriver
+var ErrNotWrapped = errors.New("instrumentedsql: database was not opened through a WrappedDriver")
+
+// DB wraps a sql.DB opened through a WrappedDriver and measures the time spent waiting for a pooled connection,
+// from the moment a call is made until the wrapped driver receives its first call on a connection.
+// The wait is traced as a sql-pool-wait span and observed as a metric of the same name.
+//
+// With WithMaxConcurrentQueries, the calls made through ExecContext, QueryContext and QueryRowContext wait for
+// their turn before waiting for a connection, so that queued queries do not hold connections others could use.
+//
+// As with the driver, only the ___Context() and BeginTx() calls are instrumented.
+type DB struct {
+	*sql.DB
+	opts
+}
+
+type poolWaitKey struct{}
+
+// poolWait tracks a single wait for a pooled connection, it is finished at most once
+type poolWait struct {
+	once sync.Once
+	call *call
+}
+
+// NewDB wraps db, which must have been opened through a WrappedDriver,
+// either by registering it or through sql.OpenDB with a connector it returned.
+func NewDB(db *sql.DB) (*DB, error) {
+	o, err := wrappedOpts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{DB: db, opts: o}, nil
+}
+
+// wrappedOpts returns the opts of the WrappedDriver db was opened through
+func wrappedOpts(db *sql.DB) (opts, error) {
+	switch d := db.Driver().(type) {
+	case WrappedDriver:
+		return d.opts, nil
+	case *WrappedDriver:
+		return d.opts, nil
+	default:
+		return opts{}, ErrNotWrapped
+	}
+}
+
+// startPoolWait starts measuring the wait for a connection, the returned function finishes it if the driver did not
+func (db *DB) startPoolWait(ctx context.Context) (context.Context, func(err error)) {
+	if db.hasOpExcluded(OpSQLPoolWait) {
+		return ctx, func(error) {}
+	}
+
+	wait := &poolWait{call: db.startCall(ctx, OpSQLPoolWait)}
+	return context.WithValue(ctx, poolWaitKey{}, wait), wait.finish
+}
+
+func (w *poolWait) finish(err error) {
+	w.once.Do(func() {
+		w.call.finish(err)
+	})
+}
+
+// endPoolWait finishes the wait for a connection started by DB, if any, once the driver receives a call with ctx
+func endPoolWait(ctx context.Context) {
+	if ctx == nil {
+		return
+	}
+
+	if wait, ok := ctx.Value(poolWaitKey{}).(*poolWait); ok {
+		wait.finish(nil)
+	}
+}
+
+// waitSlot waits for the call of op to be allowed to run within the limit of its class, see WithMaxConcurrentQueries.
+// The call the wrapped driver receives with the returned context uses the returned slot, which is to be released
+// with releaseUnclaimed once the call returns.
+func (db *DB) waitSlot(ctx context.Context, op, query string, args []interface{}) (context.Context, *limiterSlot, error) {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+		if na, ok := arg.(sql.NamedArg); ok {
+			named[i].Name, named[i].Value = na.Name, na.Value
+		}
+	}
+
+	slot, err := db.acquireSlot(ctx, &Call{Op: op, Query: query, Args: named})
+	if slot == nil || err != nil {
+		return ctx, nil, err
+	}
+
+	return context.WithValue(ctx, heldSlotKey{}, slot), slot, nil
+}
+
+// ExecContext calls sql.DB.ExecContext, measuring the wait for a connection
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	ctx, slot, err := db.waitSlot(ctx, OpSQLConnExec, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer slot.releaseUnclaimed()
+
+	ctx, done := db.startPoolWait(ctx)
+	defer func() {
+		done(err)
+	}()
+
+	return db.DB.ExecContext(ctx, query, args...)
+}
+
+// QueryContext calls sql.DB.QueryContext, measuring the wait for a connection
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	ctx, slot, err := db.waitSlot(ctx, OpSQLConnQuery, query, args)
+	if err != nil {
+		return nil, err
+	}
+	// The rows release the slot once closed
+	defer slot.releaseUnclaimed()
+
+	ctx, done := db.startPoolWait(ctx)
+	defer func() {
+		done(err)
+	}()
+
+	return db.DB.QueryContext(ctx, query, args...)
+}
+
+// QueryRowContext calls sql.DB.QueryRowContext, measuring the wait for a connection
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, slot, err := db.waitSlot(ctx, OpSQLConnQuery, query, args)
+	if err != nil {
+		// Let database/sql return the error of the context from Scan
+		return db.DB.QueryRowContext(ctx, query, args...)
+	}
+	defer slot.releaseUnclaimed()
+
+	ctx, done := db.startPoolWait(ctx)
+	row := db.DB.QueryRowContext(ctx, query, args...)
+	// The error of the row is only available from Go 1.15, a wait the driver did not end failed with the context
+	done(ctx.Err())
+
+	return row
+}
+
+// PrepareContext calls sql.DB.PrepareContext, measuring the wait for a connection
+func (db *DB) PrepareContext(ctx context.Context, query string) (stmt *sql.Stmt, err error) {
+	ctx, done := db.startPoolWait(ctx)
+	defer func() {
+		done(err)
+	}()
+
+	return db.DB.PrepareContext(ctx, query)
+}
+
+// BeginTx calls sql.DB.BeginTx, measuring the wait for a connection
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (tx *sql.Tx, err error) {
+	ctx, done := db.startPoolWait(ctx)
+	defer func() {
+		done(err)
+	}()
+
+	return db.DB.BeginTx(ctx, opts)
+}
+
+// Conn calls sql.DB.Conn, measuring the wait for a connection
+func (db *DB) Conn(ctx context.Context) (conn *sql.Conn, err error) {
+	ctx, done := db.startPoolWait(ctx)
+	defer func() {
+		done(err)
+	}()
+
+	return db.DB.Conn(ctx)
+}
+
+// PingContext calls sql.DB.PingContext, measuring the wait for a connection
+func (db *DB) PingContext(ctx context.Context) (err error) {
+	ctx, done := db.startPoolWait(ctx)
+	defer func() {
+		done(err)
+	}()
+
+	return db.DB.PingContext(ctx)
+}
@@ -1,6 +1,9 @@
 package instrumentedsql
 
-import "database/sql/driver"
+import (
+	"context"
+	"database/sql/driver"
+)
 
 // WrappedDriver wraps a driver and adds instrumentation.
 // Use WrapDriver to create a new WrappedDriver.
@@ -22,6 +25,10 @@ var (
 // instead of the older calls which do not accept a context.
 func WrapDriver(driver driver.Driver, opts ...Opt) WrappedDriver {
 	d := WrappedDriver{parent: driver}
+	d.retries = newRetryTracker()
+	d.limiter = newQueryLimiter()
+	d.explainer = newExplainLimiter()
+	d.Interceptors = []Interceptor{TracingInterceptor, LoggingInterceptor, MetricsInterceptor}
 
 	for _, opt := range opts {
 		opt(&d.opts)
@@ -33,16 +40,26 @@ func WrapDriver(driver driver.Driver, opts ...Opt) WrappedDriver {
 	if d.Tracer == nil {
 		d.Tracer = nullTracer{}
 	}
+	if d.Metrics == nil {
+		d.Metrics = nullMetrics{}
+	}
 
 	return d
 }
 
 // Open implements the database/sql/driver.Driver interface for WrappedDriver.
 func (d WrappedDriver) Open(name string) (driver.Conn, error) {
+	ctx := context.Background()
+	circuit, err := d.enterCircuit(ctx, &Call{Op: OpSQLConnectorConnect})
+	if err != nil {
+		return nil, err
+	}
+
 	conn, err := d.parent.Open(name)
+	circuit.done(err)
 	if err != nil {
 		return nil, err
 	}
 
-	return wrappedConn{opts: d.opts, parent: conn}, nil
+	return newWrappedConn(ctx, d.opts, conn), nil
 }
@@ -0,0 +1,255 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net"
+	"reflect"
+)
+
+// ErrorCategory is a coarse, driver independent classification of an error returned by the wrapped driver
+type ErrorCategory string
+
+// The possible error categories attached to spans, log lines and metrics
+const (
+	ErrorCategoryUnknown             ErrorCategory = "unknown"
+	ErrorCategoryConnectionLost      ErrorCategory = "connection_lost"
+	ErrorCategoryTimeout             ErrorCategory = "timeout"
+	ErrorCategoryDeadlock            ErrorCategory = "deadlock"
+	ErrorCategorySerialization       ErrorCategory = "serialization_failure"
+	ErrorCategoryUniqueViolation     ErrorCategory = "unique_violation"
+	ErrorCategoryForeignKeyViolation ErrorCategory = "foreign_key_violation"
+	ErrorCategorySyntax              ErrorCategory = "syntax_error"
+	ErrorCategoryPermissionDenied    ErrorCategory = "permission_denied"
+)
+
+// ErrorClassifier maps a driver error to an ErrorCategory.
+// It should return an empty category for errors it does not recognise, so that the next classifier is consulted.
+type ErrorClassifier func(err error) ErrorCategory
+
+// ErrorFilter reports whether err returned by op is expected, in which case it does not mark the span as failed
+// and is not logged as an error.
+type ErrorFilter func(op string, err error) bool
+
+// DefaultErrorFilter treats the sentinel errors database/sql handles itself as expected:
+// driver.ErrSkip makes it fall back to another code path and io.EOF signals the end of a result set.
+// driver.ErrBadConn is not, as database/sql does not retry the calls of a *sql.Conn or a transaction and returns it
+// to the caller once out of retries. The attempts it does retry are labeled with their attempt number.
+func DefaultErrorFilter(op string, err error) bool {
+	switch err {
+	case driver.ErrSkip:
+		return true
+	case io.EOF:
+		return op == OpSQLRowsNext
+	default:
+		return false
+	}
+}
+
+// isIgnoredError reports whether err returned by op is expected, according to the ignored errors and the error filter
+func (o opts) isIgnoredError(op string, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	for _, ignored := range o.IgnoredErrors {
+		if err == ignored {
+			return true
+		}
+	}
+
+	filter := o.ErrorFilter
+	if filter == nil {
+		filter = DefaultErrorFilter
+	}
+
+	return filter(op, err)
+}
+
+// classifyError runs err through the configured classifiers followed by the generic one
+func (o opts) classifyError(err error) ErrorCategory {
+	if err == nil {
+		return ""
+	}
+
+	for _, classify := range o.ErrorClassifiers {
+		if category := classify(err); category != "" {
+			return category
+		}
+	}
+
+	if category := GenericErrorClassifier(err); category != "" {
+		return category
+	}
+
+	return ErrorCategoryUnknown
+}
+
+// GenericErrorClassifier recognises errors defined by the standard library, such as context errors,
+// driver.ErrBadConn and network errors, as well as the ReadOnlyError and CircuitOpenError of this package.
+// It is always consulted after any classifiers passed to WithErrorClassifiers.
+func GenericErrorClassifier(err error) ErrorCategory {
+	for ; err != nil; err = unwrapError(err) {
+		switch err {
+		case context.Canceled, context.DeadlineExceeded:
+			return ErrorCategoryTimeout
+		case driver.ErrBadConn, io.ErrUnexpectedEOF:
+			return ErrorCategoryConnectionLost
+		}
+
+		if netErr, ok := err.(net.Error); ok {
+			if netErr.Timeout() {
+				return ErrorCategoryTimeout
+			}
+
+			return ErrorCategoryConnectionLost
+		}
+
+		if _, ok := err.(*ReadOnlyError); ok {
+			return ErrorCategoryPermissionDenied
+		}
+		if _, ok := err.(*CircuitOpenError); ok {
+			return ErrorCategoryConnectionLost
+		}
+	}
+
+	return ""
+}
+
+// PostgresErrorClassifier classifies errors from lib/pq and pgx using their SQLSTATE code
+func PostgresErrorClassifier(err error) ErrorCategory {
+	for ; err != nil; err = unwrapError(err) {
+		code, ok := sqlState(err)
+		if !ok || len(code) != 5 {
+			continue
+		}
+
+		switch code {
+		case "40P01":
+			return ErrorCategoryDeadlock
+		case "40001":
+			return ErrorCategorySerialization
+		case "23505":
+			return ErrorCategoryUniqueViolation
+		case "23503":
+			return ErrorCategoryForeignKeyViolation
+		case "42601":
+			return ErrorCategorySyntax
+		case "42501", "28000", "28P01":
+			return ErrorCategoryPermissionDenied
+		case "57014":
+			return ErrorCategoryTimeout
+		case "57P01", "57P02", "57P03":
+			return ErrorCategoryConnectionLost
+		}
+
+		if code[:2] == "08" {
+			return ErrorCategoryConnectionLost
+		}
+	}
+
+	return ""
+}
+
+// MySQLErrorClassifier classifies errors from go-sql-driver/mysql using their error number
+func MySQLErrorClassifier(err error) ErrorCategory {
+	for ; err != nil; err = unwrapError(err) {
+		field, ok := errorField(err, "Number")
+		if !ok || field.Kind() != reflect.Uint16 {
+			continue
+		}
+
+		switch field.Uint() {
+		case 1213:
+			return ErrorCategoryDeadlock
+		case 1205, 3024:
+			return ErrorCategoryTimeout
+		case 1062, 1586:
+			return ErrorCategoryUniqueViolation
+		case 1216, 1217, 1451, 1452:
+			return ErrorCategoryForeignKeyViolation
+		case 1064, 1149:
+			return ErrorCategorySyntax
+		case 1044, 1045, 1142, 1143, 1227:
+			return ErrorCategoryPermissionDenied
+		case 1053, 2006, 2013:
+			return ErrorCategoryConnectionLost
+		}
+	}
+
+	return ""
+}
+
+// SQLiteErrorClassifier classifies errors from mattn/go-sqlite3 using their (extended) result code.
+// Lock contention (SQLITE_BUSY and SQLITE_LOCKED) is reported as a deadlock, seeing as it requires the same handling.
+func SQLiteErrorClassifier(err error) ErrorCategory {
+	for ; err != nil; err = unwrapError(err) {
+		code, ok := errorField(err, "Code")
+		if !ok || code.Kind() != reflect.Int {
+			continue
+		}
+
+		if extended, ok := errorField(err, "ExtendedCode"); ok && extended.Kind() == reflect.Int {
+			switch extended.Int() {
+			case 517: // SQLITE_BUSY_SNAPSHOT
+				return ErrorCategorySerialization
+			case 1555, 2067: // SQLITE_CONSTRAINT_PRIMARYKEY, SQLITE_CONSTRAINT_UNIQUE
+				return ErrorCategoryUniqueViolation
+			case 787: // SQLITE_CONSTRAINT_FOREIGNKEY
+				return ErrorCategoryForeignKeyViolation
+			}
+		}
+
+		switch code.Int() {
+		case 5, 6: // SQLITE_BUSY, SQLITE_LOCKED
+			return ErrorCategoryDeadlock
+		case 3, 8, 23: // SQLITE_PERM, SQLITE_READONLY, SQLITE_AUTH
+			return ErrorCategoryPermissionDenied
+		}
+	}
+
+	return ""
+}
+
+// sqlState returns the SQLSTATE code of err, either through its SQLState method or its Code field
+func sqlState(err error) (string, bool) {
+	if stater, ok := err.(interface{ SQLState() string }); ok {
+		return stater.SQLState(), true
+	}
+
+	field, ok := errorField(err, "Code")
+	if !ok || field.Kind() != reflect.String {
+		return "", false
+	}
+
+	return field.String(), true
+}
+
+// errorField returns the named field of err if err is a struct or a pointer to one
+func errorField(err error, name string) (reflect.Value, bool) {
+	v := reflect.ValueOf(err)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+
+	field := v.FieldByName(name)
+	return field, field.IsValid()
+}
+
+// unwrapError is a copy of errors.Unwrap, which is not available in all go versions we support
+func unwrapError(err error) error {
+	u, ok := err.(interface{ Unwrap() error })
+	if !ok {
+		return nil
+	}
+
+	return u.Unwrap()
+}
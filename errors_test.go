@@ -0,0 +1,67 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+)
+
+// pqError mimics the shape of lib/pq's Error type
+type pqError struct {
+	Code string
+}
+
+func (e *pqError) Error() string { return "pq: " + e.Code }
+
+// mysqlError mimics the shape of go-sql-driver/mysql's MySQLError type
+type mysqlError struct {
+	Number  uint16
+	Message string
+}
+
+func (e *mysqlError) Error() string { return e.Message }
+
+// sqliteError mimics the shape of mattn/go-sqlite3's Error type
+type sqliteError struct {
+	Code         int
+	ExtendedCode int
+}
+
+func (e sqliteError) Error() string { return "sqlite error" }
+
+type wrapError struct {
+	err error
+}
+
+func (e wrapError) Error() string { return "wrapped: " + e.err.Error() }
+func (e wrapError) Unwrap() error { return e.err }
+
+func TestClassifyError(t *testing.T) {
+	o := opts{ErrorClassifiers: []ErrorClassifier{PostgresErrorClassifier, MySQLErrorClassifier, SQLiteErrorClassifier}}
+
+	tests := []struct {
+		name string
+		err  error
+		want ErrorCategory
+	}{
+		{name: "nil", err: nil, want: ""},
+		{name: "unknown", err: fmt.Errorf("boom"), want: ErrorCategoryUnknown},
+		{name: "bad conn", err: driver.ErrBadConn, want: ErrorCategoryConnectionLost},
+		{name: "wrapped context", err: wrapError{context.DeadlineExceeded}, want: ErrorCategoryTimeout},
+		{name: "postgres deadlock", err: &pqError{Code: "40P01"}, want: ErrorCategoryDeadlock},
+		{name: "postgres serialization", err: wrapError{&pqError{Code: "40001"}}, want: ErrorCategorySerialization},
+		{name: "postgres connection class", err: &pqError{Code: "08006"}, want: ErrorCategoryConnectionLost},
+		{name: "mysql duplicate", err: &mysqlError{Number: 1062}, want: ErrorCategoryUniqueViolation},
+		{name: "mysql fk", err: &mysqlError{Number: 1452}, want: ErrorCategoryForeignKeyViolation},
+		{name: "sqlite unique", err: sqliteError{Code: 19, ExtendedCode: 2067}, want: ErrorCategoryUniqueViolation},
+		{name: "sqlite busy", err: sqliteError{Code: 5, ExtendedCode: 5}, want: ErrorCategoryDeadlock},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := o.classifyError(test.err); got != test.want {
+				t.Errorf("expected category %q, got %q", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luna-duclos/instrumentedsql/sqlclass"
+)
+
+const (
+	// explainTimeout bounds the time taken to explain a query
+	explainTimeout = 5 * time.Second
+	// explainStatementWindow is how long a statement is not explained again after it was
+	explainStatementWindow = 10 * time.Minute
+	// maxExplainedStatements is the maximum number of explained statements remembered at once, stale ones are pruned
+	// and the one explained the longest ago is evicted beyond it
+	maxExplainedStatements = 1024
+)
+
+// ExplainFunc returns the plan of query with args, as explained by the database on conn, see WithSlowQueryExplain
+type ExplainFunc func(ctx context.Context, conn driver.Conn, query string, args []driver.NamedValue) (string, error)
+
+// ExplainQuery returns an ExplainFunc running query prefixed with prefix, such as "EXPLAIN ", on the connection.
+// The plan is made of the rows returned, one per line, their columns separated by tabs.
+// The wrapped driver must implement driver.QueryerContext or driver.Queryer.
+func ExplainQuery(prefix string) ExplainFunc {
+	return explainQuery(prefix, "")
+}
+
+var (
+	// PostgresExplain explains Postgres queries with EXPLAIN, which plans them without running them
+	PostgresExplain = ExplainQuery("EXPLAIN ")
+	// MySQLExplain explains MySQL queries with EXPLAIN FORMAT=JSON
+	MySQLExplain = ExplainQuery("EXPLAIN FORMAT=JSON ")
+	// SQLiteExplain explains SQLite queries with EXPLAIN QUERY PLAN, keeping the detail of each step
+	SQLiteExplain = explainQuery("EXPLAIN QUERY PLAN ", "detail")
+)
+
+// explainQuery returns an ExplainFunc running query prefixed with prefix, keeping only column if set
+func explainQuery(prefix, column string) ExplainFunc {
+	return func(ctx context.Context, conn driver.Conn, query string, args []driver.NamedValue) (string, error) {
+		var rows driver.Rows
+		var err error
+		switch queryer := conn.(type) {
+		case driver.QueryerContext:
+			rows, err = queryer.QueryContext(ctx, prefix+query, args)
+		case driver.Queryer:
+			values := make([]driver.Value, len(args))
+			for i, arg := range args {
+				values[i] = arg.Value
+			}
+			rows, err = queryer.Query(prefix+query, values)
+		default:
+			return "", driver.ErrSkip
+		}
+		if err != nil {
+			return "", err
+		}
+		defer rows.Close()
+
+		columns := rows.Columns()
+		keep := -1
+		for i, c := range columns {
+			if column != "" && strings.EqualFold(c, column) {
+				keep = i
+			}
+		}
+
+		var lines []string
+		dest := make([]driver.Value, len(columns))
+		for {
+			if err := rows.Next(dest); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return "", err
+			}
+
+			values := dest
+			if keep >= 0 {
+				values = dest[keep : keep+1]
+			}
+			fields := make([]string, len(values))
+			for i, v := range values {
+				if b, ok := v.([]byte); ok {
+					fields[i] = string(b)
+				} else {
+					fields[i] = fmt.Sprint(v)
+				}
+			}
+			lines = append(lines, strings.Join(fields, "\t"))
+		}
+
+		return strings.Join(lines, "\n"), nil
+	}
+}
+
+// explainableOperations are the operations of the statements which are explained
+var explainableOperations = map[string]bool{
+	"SELECT":  true,
+	"INSERT":  true,
+	"UPDATE":  true,
+	"DELETE":  true,
+	"REPLACE": true,
+}
+
+// explainLimiter rate limits the queries a wrapped driver explains
+type explainLimiter struct {
+	mu        sync.Mutex
+	last      time.Time
+	explained map[string]time.Time
+}
+
+func newExplainLimiter() *explainLimiter {
+	return &explainLimiter{explained: make(map[string]time.Time)}
+}
+
+// allow reports whether statement may be explained now, counting it as explained if so
+func (l *explainLimiter) allow(statement string, interval time.Duration) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.last) < interval {
+		return false
+	}
+	if at, ok := l.explained[statement]; ok && now.Sub(at) < explainStatementWindow {
+		return false
+	}
+
+	if _, ok := l.explained[statement]; !ok && len(l.explained) >= maxExplainedStatements {
+		l.prune(now)
+	}
+	l.last = now
+	l.explained[statement] = now
+
+	return true
+}
+
+// prune forgets the statements explained before the window, or the one explained the longest ago if none was,
+// l.mu must be held
+func (l *explainLimiter) prune(now time.Time) {
+	var oldest string
+	var oldestAt time.Time
+	for s, at := range l.explained {
+		if now.Sub(at) >= explainStatementWindow {
+			delete(l.explained, s)
+		} else if oldestAt.IsZero() || at.Before(oldestAt) {
+			oldest, oldestAt = s, at
+		}
+	}
+
+	if len(l.explained) >= maxExplainedStatements {
+		delete(l.explained, oldest)
+	}
+}
+
+// explainSlow returns a function explaining the query of a successful call on conn if it took longer than the threshold
+// since start, or nil if it is not to be explained. The function must be called once the connection is free to run
+// the plan, it records the plan as an OpSQLExplain call.
+// Only explainable statements are, at most one per interval, and not within transactions, which a failing explain
+// could abort.
+func (o opts) explainSlow(ctx context.Context, conn driver.Conn, call *Call, start time.Time) func() {
+	if o.Explain == nil || o.explainer == nil || o.hasOpExcluded(OpSQLExplain) {
+		return nil
+	}
+
+	duration := time.Since(start)
+	if duration < o.ExplainThreshold || !explainableOperations[call.Statement().Operation] {
+		return nil
+	}
+	if query := strings.TrimRight(strings.TrimSpace(call.Query), ";"); strings.Contains(query, ";") {
+		// Several statements
+		return nil
+	}
+	if id, _ := o.conn.tx(); id != "" {
+		return nil
+	}
+	if !o.explainer.allow(sqlclass.Normalize(call.Query), o.ExplainInterval) {
+		return nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	query, args := call.Query, call.Args
+	return func() {
+		explainCall := o.startCall(ctx, OpSQLExplain)
+		explainCall.setQuery(query, nil)
+		explainCall.setLabel("slow_duration", duration.String())
+
+		explainCtx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+		defer cancel()
+
+		plan, err := o.Explain(explainCtx, conn, query, args)
+		if err == nil {
+			explainCall.setLabel("plan", plan)
+		}
+		explainCall.finish(err)
+	}
+}
@@ -0,0 +1,28 @@
+package instrumentedsql
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExplainLimiterBound(t *testing.T) {
+	l := newExplainLimiter()
+	for i := 0; i < 2*maxExplainedStatements; i++ {
+		if !l.allow(fmt.Sprint(i), 0) {
+			t.Fatalf("expected statement %d to be explained", i)
+		}
+	}
+	if len(l.explained) > maxExplainedStatements {
+		t.Errorf("expected at most %d statements, got %d", maxExplainedStatements, len(l.explained))
+	}
+	if _, ok := l.explained[fmt.Sprint(2*maxExplainedStatements-1)]; !ok {
+		t.Error("expected the most recent statement to be kept")
+	}
+
+	l.explained["stale"] = time.Now().Add(-2 * explainStatementWindow)
+	l.allow("new", 0)
+	if _, ok := l.explained["stale"]; ok {
+		t.Error("expected stale statements to be pruned")
+	}
+}
@@ -0,0 +1,160 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Fault describes a fault injected into an instrumented call, see WithFaultInjector
+type Fault struct {
+	// Delay is waited before the call is forwarded to the wrapped driver, or until the context is done
+	Delay time.Duration
+	// Err is returned instead of forwarding the call to the wrapped driver
+	Err error
+	// DropResult forwards the call to the wrapped driver but discards its result, as if it was lost on the way back.
+	// Err is returned instead, or driver.ErrBadConn if Err is nil.
+	DropResult bool
+}
+
+// FaultInjector decides which fault, if any, to inject into a call of op before it is forwarded to the wrapped driver.
+// query is empty for ops which do not run a query.
+type FaultInjector interface {
+	Inject(ctx context.Context, op, query string) Fault
+}
+
+// FaultInjectorFunc is an adapter which allows a function to be used as a FaultInjector.
+type FaultInjectorFunc func(ctx context.Context, op, query string) Fault
+
+// Inject calls f(ctx, op, query).
+func (f FaultInjectorFunc) Inject(ctx context.Context, op, query string) Fault {
+	return f(ctx, op, query)
+}
+
+// FaultRule injects its Fault into the calls matching all of its criteria
+type FaultRule struct {
+	// Ops restricts the rule to calls of the listed ops, it matches any op if empty
+	Ops []string
+	// Query restricts the rule to calls with a matching query, it matches any query if nil
+	Query *regexp.Regexp
+	// Context restricts the rule to calls with a matching context, such as contexts carrying a given value
+	Context func(ctx context.Context) bool
+	// Rate is the fraction of matching calls the fault is injected into, all of them if zero
+	Rate  float64
+	Fault Fault
+}
+
+type faultRules []FaultRule
+
+// NewFaultRules returns a FaultInjector injecting the fault of the first rule matching a call
+func NewFaultRules(rules ...FaultRule) FaultInjector {
+	return faultRules(rules)
+}
+
+func (rules faultRules) Inject(ctx context.Context, op, query string) Fault {
+	for _, rule := range rules {
+		if rule.matches(ctx, op, query) {
+			return rule.Fault
+		}
+	}
+
+	return Fault{}
+}
+
+func (r FaultRule) matches(ctx context.Context, op, query string) bool {
+	if len(r.Ops) > 0 {
+		found := false
+		for _, o := range r.Ops {
+			if o == op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if r.Query != nil && !r.Query.MatchString(query) {
+		return false
+	}
+	if r.Context != nil && !r.Context(ctx) {
+		return false
+	}
+
+	return r.Rate <= 0 || rand.Float64() < r.Rate
+}
+
+// injectFault consults the fault injector before op is forwarded to the wrapped driver, labeling call with the fault.
+// It returns the fault, to be checked for DropResult once the wrapped driver returns,
+// and an error to be returned instead of forwarding the call.
+func (o opts) injectFault(ctx context.Context, call *call, op, query string) (Fault, error) {
+	if o.FaultInjector == nil {
+		return Fault{}, nil
+	}
+
+	fault := o.FaultInjector.Inject(ctx, op, query)
+
+	var kinds []string
+	if fault.Delay > 0 {
+		kinds = append(kinds, "delay")
+		call.setLabel("fault_delay", fault.Delay.String())
+	}
+	if fault.DropResult {
+		kinds = append(kinds, "drop")
+	} else if fault.Err != nil {
+		kinds = append(kinds, "error")
+	}
+	if len(kinds) == 0 {
+		return fault, nil
+	}
+	call.setLabel("fault", strings.Join(kinds, ","))
+
+	if fault.Delay > 0 {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		timer := time.NewTimer(fault.Delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return fault, ctx.Err()
+		}
+	}
+
+	if !fault.DropResult && fault.Err != nil {
+		return fault, fault.Err
+	}
+
+	return fault, nil
+}
+
+// drop discards result if the fault says so, returning the error to return instead
+func (f Fault) drop(result interface{}, err error) (bool, error) {
+	if !f.DropResult || err != nil {
+		return false, err
+	}
+
+	switch result := result.(type) {
+	case driver.Rows:
+		_ = result.Close()
+	case driver.Stmt:
+		_ = result.Close()
+	case driver.Tx:
+		_ = result.Rollback()
+	case driver.Conn:
+		_ = result.Close()
+	}
+
+	if f.Err != nil {
+		return true, f.Err
+	}
+
+	return true, driver.ErrBadConn
+}
@@ -1,13 +1,11 @@
 package instrumentedsql
 
 import (
-	"context"
 	"database/sql/driver"
 	"errors"
 	"fmt"
 	"reflect"
 	"strings"
-	"time"
 )
 
 func formatArgs(args interface{}) string {
@@ -44,21 +42,15 @@ func formatArg(arg interface{}) string {
 	return strArg
 }
 
-func logQuery(ctx context.Context, opts opts, op, query string, err error, args interface{}, since time.Time) {
-	keyvals := []interface{}{
-		"query", query,
-		"err", err,
-		"duration", time.Since(since),
+// valueToNamedValue converts the arguments of calls without a context to named values
+func valueToNamedValue(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
 	}
-
-	if !opts.OmitArgs && args != nil {
-		keyvals = append(keyvals, "args", formatArgs(args))
-	}
-
-	opts.Log(ctx, op, keyvals...)
+	return named
 }
 
-
 // namedValueToValue is a helper function copied from the database/sql package
 func namedValueToValue(named []driver.NamedValue) ([]driver.Value, error) {
 	dargs := make([]driver.Value, len(named))
@@ -0,0 +1,127 @@
+package instrumentedsqltest
+
+import (
+	"fmt"
+	"testing"
+)
+
+// AssertSpan fails the test unless a span named name was recorded with all of the passed labels,
+// which are given as alternating keys and values. It returns the first matching span.
+func AssertSpan(t testing.TB, rec *Recorder, name string, labels ...string) SpanRecord {
+	t.Helper()
+
+	spans := rec.SpansNamed(name)
+	for _, span := range spans {
+		if hasLabels(span, labels) {
+			return span
+		}
+	}
+
+	if len(spans) == 0 {
+		t.Errorf("expected a %s span, none were recorded", name)
+	} else {
+		t.Errorf("expected a %s span with labels %v, recorded: %v", name, labels, spanLabels(spans))
+	}
+
+	return SpanRecord{}
+}
+
+// AssertNoSpan fails the test if a span named name was recorded
+func AssertNoSpan(t testing.TB, rec *Recorder, name string) {
+	t.Helper()
+
+	if spans := rec.SpansNamed(name); len(spans) > 0 {
+		t.Errorf("expected no %s span, %d were recorded", name, len(spans))
+	}
+}
+
+// AssertSpanError fails the test unless the span has been marked as failed
+func AssertSpanError(t testing.TB, span SpanRecord) {
+	t.Helper()
+
+	if len(span.Errors) == 0 {
+		t.Errorf("expected %s span %d to be marked as failed", span.Name, span.ID)
+	}
+}
+
+// AssertNoSpanErrors fails the test if any recorded span has been marked as failed
+func AssertNoSpanErrors(t testing.TB, rec *Recorder) {
+	t.Helper()
+
+	for _, span := range rec.Spans() {
+		if len(span.Errors) > 0 {
+			t.Errorf("expected no failed spans, %s span %d failed with %v", span.Name, span.ID, span.Errors)
+		}
+	}
+}
+
+// AssertNoLabel fails the test if any recorded span has a label named key, such as args
+func AssertNoLabel(t testing.TB, rec *Recorder, key string) {
+	t.Helper()
+
+	for _, span := range rec.Spans() {
+		if v, ok := span.Labels[key]; ok {
+			t.Errorf("expected no span labeled %s, %s span %d has %s=%q", key, span.Name, span.ID, key, v)
+		}
+	}
+}
+
+// AssertLog fails the test unless a line with message msg was logged with all of the passed keyvals.
+// Values are compared by their formatted representation. It returns the first matching line.
+func AssertLog(t testing.TB, rec *Recorder, msg string, keyvals ...interface{}) LogRecord {
+	t.Helper()
+
+	for _, line := range rec.Logs() {
+		if line.Msg == msg && hasKeyvals(line, keyvals) {
+			return line
+		}
+	}
+
+	t.Errorf("expected a %s log line with %v", msg, keyvals)
+	return LogRecord{}
+}
+
+// AssertNoLogKey fails the test if any line was logged with key, such as args
+func AssertNoLogKey(t testing.TB, rec *Recorder, key string) {
+	t.Helper()
+
+	for _, line := range rec.Logs() {
+		if v, ok := line.Value(key); ok {
+			t.Errorf("expected no log line with %s, %s was logged with %s=%v", key, line.Msg, key, v)
+		}
+	}
+}
+
+func hasLabels(span SpanRecord, labels []string) bool {
+	for i := 0; i+1 < len(labels); i += 2 {
+		if v, ok := span.Labels[labels[i]]; !ok || v != labels[i+1] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasKeyvals(line LogRecord, keyvals []interface{}) bool {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key, ok := keyvals[i].(string)
+		if !ok {
+			return false
+		}
+		v, ok := line.Value(key)
+		if !ok || fmt.Sprint(v) != fmt.Sprint(keyvals[i+1]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func spanLabels(spans []SpanRecord) []map[string]string {
+	labels := make([]map[string]string, 0, len(spans))
+	for _, span := range spans {
+		labels = append(labels, span.Labels)
+	}
+
+	return labels
+}
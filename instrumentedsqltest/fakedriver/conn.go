@@ -0,0 +1,272 @@
+package fakedriver
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+)
+
+// conn implements the interfaces every driver.Conn has to, the optional ones are added by the mixins below
+type conn struct {
+	driver *Driver
+	id     int
+}
+
+func (c *conn) call(op Op, query string, args []driver.NamedValue) Response {
+	return c.driver.respond(Call{Op: op, Query: query, Args: args, Conn: c.id})
+}
+
+func (c *conn) prepare(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := c.call(OpPrepare, query, nil).wait(ctx); err != nil {
+		return nil, err
+	}
+
+	s := &stmt{conn: c, query: query}
+	if c.driver.features.NoContext {
+		return s, nil
+	}
+
+	return struct {
+		*stmt
+		stmtContext
+	}{s, stmtContext{s}}, nil
+}
+
+func (c *conn) exec(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	resp := c.call(OpExec, query, args)
+	if err := resp.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return result{resp}, nil
+}
+
+func (c *conn) query(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	resp := c.call(OpQuery, query, args)
+	if err := resp.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return &rows{resp: resp}, nil
+}
+
+func (c *conn) begin(ctx context.Context) (driver.Tx, error) {
+	if err := c.call(OpBegin, "", nil).wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return tx{c}, nil
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.prepare(context.Background(), query)
+}
+
+func (c *conn) Close() error {
+	return c.call(OpClose, "", nil).wait(nil)
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.begin(context.Background())
+}
+
+// wrapConn returns c implementing the optional interfaces selected by the driver's features
+func (d *Driver) wrapConn(c *conn) driver.Conn {
+	f := d.features
+	switch {
+	case f.NoContext && f.NoExecer && f.NoQueryer:
+		return c
+	case f.NoContext && f.NoQueryer:
+		return struct {
+			*conn
+			execer
+		}{c, execer{c}}
+	case f.NoContext && f.NoExecer:
+		return struct {
+			*conn
+			queryer
+		}{c, queryer{c}}
+	case f.NoContext:
+		return struct {
+			*conn
+			execer
+			queryer
+		}{c, execer{c}, queryer{c}}
+	case f.NoExecer && f.NoQueryer:
+		return struct {
+			*conn
+			connContext
+		}{c, connContext{c}}
+	case f.NoQueryer:
+		return struct {
+			*conn
+			connContext
+			execer
+			execerContext
+		}{c, connContext{c}, execer{c}, execerContext{c}}
+	case f.NoExecer:
+		return struct {
+			*conn
+			connContext
+			queryer
+			queryerContext
+		}{c, connContext{c}, queryer{c}, queryerContext{c}}
+	default:
+		return struct {
+			*conn
+			connContext
+			execer
+			execerContext
+			queryer
+			queryerContext
+		}{c, connContext{c}, execer{c}, execerContext{c}, queryer{c}, queryerContext{c}}
+	}
+}
+
+// connContext adds the context aware interfaces other than ExecerContext and QueryerContext
+type connContext struct {
+	c *conn
+}
+
+func (c connContext) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.c.prepare(ctx, query)
+}
+
+func (c connContext) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.c.begin(ctx)
+}
+
+func (c connContext) Ping(ctx context.Context) error {
+	return c.c.call(OpPing, "", nil).wait(ctx)
+}
+
+func (c connContext) ResetSession(ctx context.Context) error {
+	return c.c.call(OpResetSession, "", nil).wait(ctx)
+}
+
+type execer struct {
+	c *conn
+}
+
+func (e execer) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return e.c.exec(context.Background(), query, valuesToNamed(args))
+}
+
+type execerContext struct {
+	c *conn
+}
+
+func (e execerContext) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return e.c.exec(ctx, query, args)
+}
+
+type queryer struct {
+	c *conn
+}
+
+func (q queryer) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return q.c.query(context.Background(), query, valuesToNamed(args))
+}
+
+type queryerContext struct {
+	c *conn
+}
+
+func (q queryerContext) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return q.c.query(ctx, query, args)
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return s.conn.call(OpStmtClose, s.query, nil).wait(nil)
+}
+
+// NumInput returns -1, as the fake driver does not parse queries
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.exec(context.Background(), s.query, valuesToNamed(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.query(context.Background(), s.query, valuesToNamed(args))
+}
+
+// stmtContext adds the context aware statement interfaces
+type stmtContext struct {
+	s *stmt
+}
+
+func (s stmtContext) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.s.conn.exec(ctx, s.s.query, args)
+}
+
+func (s stmtContext) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.s.conn.query(ctx, s.s.query, args)
+}
+
+type tx struct {
+	c *conn
+}
+
+func (t tx) Commit() error {
+	return t.c.call(OpCommit, "", nil).wait(nil)
+}
+
+func (t tx) Rollback() error {
+	return t.c.call(OpRollback, "", nil).wait(nil)
+}
+
+type result struct {
+	resp Response
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return r.resp.LastInsertID, nil
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return r.resp.RowsAffected, nil
+}
+
+type rows struct {
+	resp Response
+	next int
+}
+
+func (r *rows) Columns() []string {
+	return r.resp.Columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.resp.Rows) {
+		if r.resp.RowsErr != nil {
+			return r.resp.RowsErr
+		}
+		return io.EOF
+	}
+
+	copy(dest, r.resp.Rows[r.next])
+	r.next++
+
+	return nil
+}
+
+func valuesToNamed(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+
+	return named
+}
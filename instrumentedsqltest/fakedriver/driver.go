@@ -0,0 +1,238 @@
+// Package fakedriver provides a scriptable in-memory database/sql driver for tests.
+//
+// Every call made on the driver is matched against the scripted responses registered with On and Once,
+// the first matching response determines the outcome of the call. Calls without a matching response succeed
+// with an empty result. Which optional database/sql/driver interfaces are implemented is controlled through Features.
+package fakedriver
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync"
+	"time"
+)
+
+// Op identifies the kind of call made on the driver
+type Op string
+
+// The ops responses can be scripted for
+const (
+	OpConnect      Op = "connect"
+	OpPrepare      Op = "prepare"
+	OpExec         Op = "exec"
+	OpQuery        Op = "query"
+	OpBegin        Op = "begin"
+	OpCommit       Op = "commit"
+	OpRollback     Op = "rollback"
+	OpPing         Op = "ping"
+	OpResetSession Op = "reset-session"
+	OpStmtClose    Op = "stmt-close"
+	OpClose        Op = "close"
+)
+
+// Features controls which optional interfaces the driver, its connections and statements implement.
+// The zero value implements all of them.
+type Features struct {
+	// NoContext makes connections and statements implement only the interfaces without context support
+	NoContext bool
+	// NoExecer makes connections implement neither driver.Execer nor driver.ExecerContext,
+	// so database/sql falls back to prepare and exec
+	NoExecer bool
+	// NoQueryer makes connections implement neither driver.Queryer nor driver.QueryerContext,
+	// so database/sql falls back to prepare and query
+	NoQueryer bool
+	// NoConnector makes the driver not implement driver.DriverContext
+	NoConnector bool
+}
+
+// Response is the scripted outcome of a call
+type Response struct {
+	// Err is returned by the call, such as driver.ErrBadConn or driver.ErrSkip
+	Err error
+	// Delay is waited before the call returns, a call with a context returns early once it is done
+	Delay time.Duration
+	// Columns and Rows are returned by OpQuery calls
+	Columns []string
+	Rows    [][]driver.Value
+	// RowsErr is returned by Rows.Next once all rows have been returned, instead of io.EOF
+	RowsErr error
+	// LastInsertID and RowsAffected are returned by the result of OpExec calls
+	LastInsertID int64
+	RowsAffected int64
+}
+
+// Call is a call recorded by the driver
+type Call struct {
+	Op    Op
+	Query string
+	Args  []driver.NamedValue
+	// Conn is the number of the connection the call was made on, starting at 1
+	Conn int
+}
+
+type rule struct {
+	op    Op
+	query string
+	resp  Response
+	once  bool
+}
+
+// Driver is a scriptable in-memory driver.Driver
+type Driver struct {
+	features Features
+
+	mu    sync.Mutex
+	rules []*rule
+	calls []Call
+	conns int
+}
+
+// New returns a Driver implementing the interfaces selected by features. The returned value implements
+// driver.DriverContext unless features.NoConnector is set.
+func New(features Features) driver.Driver {
+	d := &Driver{features: features}
+	if features.NoConnector {
+		return d
+	}
+
+	return connectorDriver{d}
+}
+
+// Of returns the Driver underlying a driver returned by New, so it can be scripted after being registered
+func Of(d driver.Driver) *Driver {
+	switch d := d.(type) {
+	case *Driver:
+		return d
+	case connectorDriver:
+		return d.Driver
+	default:
+		return nil
+	}
+}
+
+// On scripts resp as the outcome of every op call matching query, an empty query matches any.
+// OpExec and OpQuery apply to calls made both on connections and on prepared statements.
+// Responses are matched in the order they were scripted.
+func (d *Driver) On(op Op, query string, resp Response) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rules = append(d.rules, &rule{op: op, query: query, resp: resp})
+}
+
+// Once is like On, but the response only applies to the first matching call
+func (d *Driver) Once(op Op, query string, resp Response) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rules = append(d.rules, &rule{op: op, query: query, resp: resp, once: true})
+}
+
+// Calls returns the calls made on the driver so far
+func (d *Driver) Calls() []Call {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]Call(nil), d.calls...)
+}
+
+// CallsOf returns the calls of op made on the driver so far
+func (d *Driver) CallsOf(op Op) []Call {
+	var calls []Call
+	for _, call := range d.Calls() {
+		if call.Op == op {
+			calls = append(calls, call)
+		}
+	}
+
+	return calls
+}
+
+// Reset forgets the scripted responses and recorded calls
+func (d *Driver) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.rules = nil
+	d.calls = nil
+}
+
+// Open implements driver.Driver
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	return d.connect(context.Background())
+}
+
+func (d *Driver) connect(ctx context.Context) (driver.Conn, error) {
+	d.mu.Lock()
+	d.conns++
+	c := &conn{driver: d, id: d.conns}
+	d.mu.Unlock()
+
+	if err := d.respond(Call{Op: OpConnect, Conn: c.id}).wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return d.wrapConn(c), nil
+}
+
+// respond records call and returns its scripted response
+func (d *Driver) respond(call Call) Response {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.calls = append(d.calls, call)
+	for i, r := range d.rules {
+		if r.op != call.Op || (r.query != "" && r.query != call.Query) {
+			continue
+		}
+		if r.once {
+			d.rules = append(d.rules[:i:i], d.rules[i+1:]...)
+		}
+
+		return r.resp
+	}
+
+	return Response{}
+}
+
+// wait waits for the delay of the response and returns its error
+func (r Response) wait(ctx context.Context) error {
+	if r.Delay > 0 {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		timer := time.NewTimer(r.Delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return r.Err
+}
+
+// connectorDriver is a Driver implementing driver.DriverContext
+type connectorDriver struct {
+	*Driver
+}
+
+// OpenConnector implements driver.DriverContext
+func (d connectorDriver) OpenConnector(name string) (driver.Connector, error) {
+	return connector{d}, nil
+}
+
+type connector struct {
+	d connectorDriver
+}
+
+func (c connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.d.connect(ctx)
+}
+
+func (c connector) Driver() driver.Driver {
+	return c.d
+}
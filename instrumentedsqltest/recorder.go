@@ -0,0 +1,228 @@
+// Package instrumentedsqltest provides a Tracer and Logger recording everything instrumentedsql emits,
+// along with assertion helpers, for use in tests.
+package instrumentedsqltest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/luna-duclos/instrumentedsql"
+)
+
+// Recorder is an instrumentedsql.Tracer and instrumentedsql.Logger which records every span and log line,
+// so that they can be inspected once the code under test has run.
+//
+// Spans started from a context without a recorded span are recorded as roots, use StartSpan to record a parent.
+type Recorder struct {
+	mu    sync.Mutex
+	seq   int
+	spans []*recordedSpan
+	logs  []LogRecord
+}
+
+// SpanRecord is a snapshot of a recorded span
+type SpanRecord struct {
+	// ID is the position of the span in the order spans were started, starting at 1
+	ID int
+	// ParentID is the ID of the parent span, or 0 for root spans
+	ParentID int
+	Name     string
+	Labels   map[string]string
+	Errors   []error
+	// Started and Finished are sequence numbers which order the starts and finishes of all spans,
+	// Finished is 0 if the span was not finished.
+	Started  int
+	Finished int
+}
+
+// LogRecord is a recorded log line
+type LogRecord struct {
+	Msg     string
+	Keyvals []interface{}
+}
+
+type recordedSpan struct {
+	rec    *Recorder
+	record SpanRecord
+}
+
+type spanKey struct{}
+
+// Compile time validation that our types implement the expected interfaces
+var (
+	_ instrumentedsql.Tracer = &Recorder{}
+	_ instrumentedsql.Logger = &Recorder{}
+	_ instrumentedsql.Span   = &recordedSpan{}
+)
+
+// NewRecorder returns an empty Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// StartSpan records a new root span named name and returns a context containing it,
+// so that spans created by instrumentedsql with that context are recorded as its children.
+func (r *Recorder) StartSpan(ctx context.Context, name string) (context.Context, instrumentedsql.Span) {
+	span := r.newSpan(0, name)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// GetSpan returns the recorded span contained in ctx, or a span whose children are recorded as roots
+func (r *Recorder) GetSpan(ctx context.Context) instrumentedsql.Span {
+	if ctx != nil {
+		if span, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+			return span
+		}
+	}
+
+	return rootSpan{rec: r}
+}
+
+// Log records a log line
+func (r *Recorder) Log(ctx context.Context, msg string, keyvals ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.logs = append(r.logs, LogRecord{Msg: msg, Keyvals: append([]interface{}(nil), keyvals...)})
+}
+
+// Spans returns a snapshot of the recorded spans, in the order they were started
+func (r *Recorder) Spans() []SpanRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	spans := make([]SpanRecord, 0, len(r.spans))
+	for _, span := range r.spans {
+		spans = append(spans, span.snapshot())
+	}
+
+	return spans
+}
+
+// SpansNamed returns a snapshot of the recorded spans named name, in the order they were started
+func (r *Recorder) SpansNamed(name string) []SpanRecord {
+	var spans []SpanRecord
+	for _, span := range r.Spans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+
+	return spans
+}
+
+// Children returns a snapshot of the recorded children of the span with the passed ID
+func (r *Recorder) Children(id int) []SpanRecord {
+	var spans []SpanRecord
+	for _, span := range r.Spans() {
+		if span.ParentID == id {
+			spans = append(spans, span)
+		}
+	}
+
+	return spans
+}
+
+// Logs returns the recorded log lines, in the order they were logged
+func (r *Recorder) Logs() []LogRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]LogRecord(nil), r.logs...)
+}
+
+// Reset forgets everything recorded so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.spans = nil
+	r.logs = nil
+}
+
+func (r *Recorder) newSpan(parentID int, name string) *recordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.seq++
+	span := &recordedSpan{rec: r, record: SpanRecord{
+		ID:       len(r.spans) + 1,
+		ParentID: parentID,
+		Name:     name,
+		Labels:   map[string]string{},
+		Started:  r.seq,
+	}}
+	r.spans = append(r.spans, span)
+
+	return span
+}
+
+// snapshot copies the record, the recorder must be locked
+func (s *recordedSpan) snapshot() SpanRecord {
+	record := s.record
+	record.Labels = make(map[string]string, len(s.record.Labels))
+	for k, v := range s.record.Labels {
+		record.Labels[k] = v
+	}
+	record.Errors = append([]error(nil), s.record.Errors...)
+
+	return record
+}
+
+func (s *recordedSpan) NewChild(name string) instrumentedsql.Span {
+	return s.rec.newSpan(s.record.ID, name)
+}
+
+func (s *recordedSpan) SetLabel(k, v string) {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+
+	s.record.Labels[k] = v
+}
+
+func (s *recordedSpan) SetError(err error) {
+	if err == nil {
+		return
+	}
+
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+
+	s.record.Errors = append(s.record.Errors, err)
+}
+
+func (s *recordedSpan) Finish() {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+
+	if s.record.Finished == 0 {
+		s.rec.seq++
+		s.record.Finished = s.rec.seq
+	}
+}
+
+// rootSpan is returned for contexts without a recorded span, it records its children as roots
+type rootSpan struct {
+	rec *Recorder
+}
+
+func (s rootSpan) NewChild(name string) instrumentedsql.Span {
+	return s.rec.newSpan(0, name)
+}
+
+func (rootSpan) SetLabel(k, v string) {}
+
+func (rootSpan) SetError(err error) {}
+
+func (rootSpan) Finish() {}
+
+// Value returns the value logged for key, if any
+func (l LogRecord) Value(key string) (interface{}, bool) {
+	for i := 0; i+1 < len(l.Keyvals); i += 2 {
+		if l.Keyvals[i] == key {
+			return l.Keyvals[i+1], true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,33 @@
+package instrumentedsqltest
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	rec := NewRecorder()
+	ctx, parent := rec.StartSpan(context.Background(), "request")
+
+	child := rec.GetSpan(ctx).NewChild("sql-conn-query")
+	child.SetLabel("query", "SELECT 1")
+	child.SetError(errors.New("boom"))
+	child.Finish()
+	parent.Finish()
+
+	rec.Log(ctx, "sql-conn-query", "query", "SELECT 1", "err", nil)
+
+	span := AssertSpan(t, rec, "sql-conn-query", "query", "SELECT 1")
+	AssertSpanError(t, span)
+	AssertNoLabel(t, rec, "args")
+	AssertLog(t, rec, "sql-conn-query", "query", "SELECT 1")
+	AssertNoLogKey(t, rec, "args")
+
+	if children := rec.Children(1); len(children) != 1 || children[0].ID != span.ID {
+		t.Errorf("expected the query span to be the only child of the request span, got %v", children)
+	}
+	if request := rec.Spans()[0]; request.Finished < span.Finished {
+		t.Errorf("expected the request span to finish after its child")
+	}
+}
@@ -0,0 +1,93 @@
+package instrumentedsqltest
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+
+	"github.com/luna-duclos/instrumentedsql"
+	"github.com/luna-duclos/instrumentedsql/instrumentedsqltest/fakedriver"
+)
+
+// ErrNoRecording is returned by a replay driver for exec and query calls that do not match a recording
+var ErrNoRecording = errors.New("instrumentedsqltest: no recording matches the query")
+
+// knownErrors maps the messages of well known errors back to them, other recorded errors are replayed as new errors
+var knownErrors = map[string]error{
+	driver.ErrBadConn.Error():        driver.ErrBadConn,
+	context.Canceled.Error():         context.Canceled,
+	context.DeadlineExceeded.Error(): context.DeadlineExceeded,
+	io.EOF.Error():                   io.EOF,
+}
+
+// NewReplayDriver returns a driver serving the exec and query calls recorded by an instrumentedsql.QueryRecorder.
+// Each recorded call is served once, in the order it was recorded, to the first call of the same query,
+// whether it is made on a connection or on a prepared statement. Arguments are not matched.
+// Calls without a matching recording fail with ErrNoRecording, other calls succeed.
+//
+// Use fakedriver.Of on the returned driver to script further responses or inspect the calls made.
+func NewReplayDriver(r io.Reader) (driver.Driver, error) {
+	calls, err := instrumentedsql.ReadRecordings(r)
+	if err != nil {
+		return nil, err
+	}
+
+	d := fakedriver.New(fakedriver.Features{})
+	fake := fakedriver.Of(d)
+	for _, call := range calls {
+		var op fakedriver.Op
+		switch call.Op {
+		case instrumentedsql.OpSQLConnExec, instrumentedsql.OpSQLStmtExec:
+			op = fakedriver.OpExec
+		case instrumentedsql.OpSQLConnQuery, instrumentedsql.OpSQLStmtQuery:
+			op = fakedriver.OpQuery
+		default:
+			continue
+		}
+		if call.Err == driver.ErrSkip.Error() {
+			// database/sql fell back to a prepared statement, which is recorded on its own
+			continue
+		}
+
+		fake.Once(op, call.Query, replayResponse(call))
+	}
+	fake.On(fakedriver.OpExec, "", fakedriver.Response{Err: ErrNoRecording})
+	fake.On(fakedriver.OpQuery, "", fakedriver.Response{Err: ErrNoRecording})
+
+	return d, nil
+}
+
+func replayResponse(call instrumentedsql.RecordedCall) fakedriver.Response {
+	resp := fakedriver.Response{
+		Err:     replayError(call.Err),
+		RowsErr: replayError(call.RowsErr),
+		Columns: call.Columns,
+	}
+	for _, row := range call.Rows {
+		values := make([]driver.Value, len(row))
+		for i, v := range row {
+			values[i] = v.Value
+		}
+		resp.Rows = append(resp.Rows, values)
+	}
+	if call.LastInsertID != nil {
+		resp.LastInsertID = *call.LastInsertID
+	}
+	if call.RowsAffected != nil {
+		resp.RowsAffected = *call.RowsAffected
+	}
+
+	return resp
+}
+
+func replayError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	if err, ok := knownErrors[msg]; ok {
+		return err
+	}
+
+	return errors.New(msg)
+}
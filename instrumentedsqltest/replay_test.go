@@ -0,0 +1,113 @@
+// +build go1.10
+
+package instrumentedsqltest
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/luna-duclos/instrumentedsql"
+	"github.com/luna-duclos/instrumentedsql/instrumentedsqltest/fakedriver"
+)
+
+func openConnector(t *testing.T, d driver.Driver) *sql.DB {
+	t.Helper()
+
+	connector, err := d.(driver.DriverContext).OpenConnector("fake")
+	if err != nil {
+		t.Fatalf("unexpected error from OpenConnector: %+v\n", err)
+	}
+
+	return sql.OpenDB(connector)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := instrumentedsql.NewQueryRecorder(&buf)
+
+	fake := fakedriver.New(fakedriver.Features{})
+	fakedriver.Of(fake).On(fakedriver.OpQuery, "SELECT id, name FROM users", fakedriver.Response{
+		Columns: []string{"id", "name"},
+		Rows:    [][]driver.Value{{int64(1), []byte("luna")}, {int64(2), nil}},
+	})
+	fakedriver.Of(fake).On(fakedriver.OpExec, "DELETE FROM users WHERE id = ?", fakedriver.Response{RowsAffected: 1})
+
+	db := openConnector(t, instrumentedsql.WrapDriver(fake, instrumentedsql.WithQueryRecorder(recorder), instrumentedsql.WithOpsExcluded(instrumentedsql.OpSQLRowsNext)))
+	defer db.Close()
+	if _, err := db.ExecContext(context.Background(), "DELETE FROM users WHERE id = ?", 2); err != nil {
+		t.Fatalf("unexpected error executing: %+v\n", err)
+	}
+	readUsers(t, db)
+	if err := recorder.Err(); err != nil {
+		t.Fatalf("unexpected error recording: %+v\n", err)
+	}
+
+	calls, err := instrumentedsql.ReadRecordings(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error reading the recording: %+v\n", err)
+	}
+	var exec, query *instrumentedsql.RecordedCall
+	for i := range calls {
+		switch calls[i].Op {
+		case instrumentedsql.OpSQLConnExec:
+			exec = &calls[i]
+		case instrumentedsql.OpSQLConnQuery:
+			query = &calls[i]
+		}
+	}
+	if exec == nil || len(exec.Args) != 1 || exec.Args[0].Value.Value != int64(2) || exec.RowsAffected == nil || *exec.RowsAffected != 1 {
+		t.Errorf("expected the exec to be recorded with its argument and result, got %+v", exec)
+	}
+	if query == nil || len(query.Rows) != 2 {
+		t.Fatalf("expected the query to be recorded with its rows, got %+v", query)
+	}
+
+	replay, err := NewReplayDriver(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error loading the recording: %+v\n", err)
+	}
+	db = openConnector(t, replay)
+	defer db.Close()
+
+	res, err := db.ExecContext(context.Background(), "DELETE FROM users WHERE id = ?", 2)
+	if err != nil {
+		t.Fatalf("unexpected error replaying the exec: %+v\n", err)
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		t.Errorf("expected the recorded rows affected, got %d", n)
+	}
+	readUsers(t, db)
+
+	if _, err := db.QueryContext(context.Background(), "SELECT id, name FROM users"); err != ErrNoRecording {
+		t.Errorf("expected recordings to be served once, got %v", err)
+	}
+}
+
+func readUsers(t *testing.T, db *sql.DB) {
+	t.Helper()
+
+	rows, err := db.QueryContext(context.Background(), "SELECT id, name FROM users")
+	if err != nil {
+		t.Fatalf("unexpected error querying: %+v\n", err)
+	}
+	defer rows.Close()
+
+	var names []sql.NullString
+	for rows.Next() {
+		var id int64
+		var name sql.NullString
+		if err := rows.Scan(&id, &name); err != nil {
+			t.Fatalf("unexpected error scanning: %+v\n", err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("unexpected error reading rows: %+v\n", err)
+	}
+	if len(names) != 2 || names[0].String != "luna" || names[1].Valid {
+		t.Errorf("expected both rows, got %v", names)
+	}
+}
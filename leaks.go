@@ -0,0 +1,187 @@
+package instrumentedsql
+
+import (
+	"context"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The reasons a handle is reported as leaked
+const (
+	LeakReasonTimeout    = "timeout"
+	LeakReasonConnClosed = "conn-closed"
+)
+
+// Leak describes a statement or rows handle that was not closed in time
+type Leak struct {
+	// Kind is either stmt or rows
+	Kind    string
+	Query   string
+	ConnID  uint64
+	Created time.Time
+	// Stack is the stack trace of the goroutine that created the handle
+	Stack string
+	// Reason is either LeakReasonTimeout or LeakReasonConnClosed
+	Reason string
+}
+
+// LeakDetector tracks the statements and rows handed out by a wrapped driver and reports, through the driver's logger,
+// any that are not closed within a given duration or are still open when their connection is closed.
+// Use WithLeakDetector to enable it.
+type LeakDetector struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	open   map[*trackedHandle]struct{}
+	leaked []Leak
+}
+
+// trackedHandle is a statement or rows handle tracked by a LeakDetector
+type trackedHandle struct {
+	detector *LeakDetector
+	opts     opts
+	ctx      context.Context
+	leak     Leak
+	conn     *connInfo
+	timer    *time.Timer
+	once     sync.Once
+}
+
+// NewLeakDetector returns a LeakDetector reporting handles that are still open after timeout
+func NewLeakDetector(timeout time.Duration) *LeakDetector {
+	return &LeakDetector{
+		timeout: timeout,
+		open:    make(map[*trackedHandle]struct{}),
+	}
+}
+
+// Open returns the handles that are currently open and not yet reported as leaked, oldest first
+func (d *LeakDetector) Open() []Leak {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	open := make([]Leak, 0, len(d.open))
+	for h := range d.open {
+		open = append(open, h.leak)
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return open[i].Created.Before(open[j].Created)
+	})
+
+	return open
+}
+
+// Leaks returns every handle reported as leaked so far, including those that were closed afterwards
+func (d *LeakDetector) Leaks() []Leak {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]Leak(nil), d.leaked...)
+}
+
+// Reset forgets the leaks reported so far, handles that are open remain tracked
+func (d *LeakDetector) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.leaked = nil
+}
+
+// track starts tracking a handle of kind, it returns nil if no leak detector is configured
+func (o opts) track(ctx context.Context, kind, query string) *trackedHandle {
+	d := o.LeakDetector
+	if d == nil {
+		return nil
+	}
+
+	h := &trackedHandle{
+		detector: d,
+		opts:     o,
+		ctx:      ctx,
+		conn:     o.conn,
+		leak: Leak{
+			Kind:    kind,
+			Query:   query,
+			Created: time.Now(),
+			Stack:   string(debug.Stack()),
+		},
+	}
+	if o.conn != nil {
+		h.leak.ConnID = o.conn.id
+	}
+
+	d.mu.Lock()
+	d.open[h] = struct{}{}
+	d.mu.Unlock()
+
+	h.timer = time.AfterFunc(d.timeout, func() {
+		h.report(LeakReasonTimeout)
+	})
+
+	return h
+}
+
+// closed stops tracking the handle
+func (h *trackedHandle) closed() {
+	if h == nil {
+		return
+	}
+
+	h.timer.Stop()
+
+	h.detector.mu.Lock()
+	delete(h.detector.open, h)
+	h.detector.mu.Unlock()
+}
+
+// report reports the handle as leaked, at most once, and stops tracking it
+func (h *trackedHandle) report(reason string) {
+	h.once.Do(func() {
+		h.detector.mu.Lock()
+		if _, ok := h.detector.open[h]; !ok {
+			h.detector.mu.Unlock()
+			return
+		}
+		delete(h.detector.open, h)
+		leak := h.leak
+		leak.Reason = reason
+		h.detector.leaked = append(h.detector.leaked, leak)
+		h.detector.mu.Unlock()
+
+		ctx := h.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		h.opts.Log(ctx, OpSQLLeak,
+			"kind", leak.Kind,
+			"query", leak.Query,
+			"db.conn.id", strconv.FormatUint(leak.ConnID, 10),
+			"reason", reason,
+			"age", time.Since(leak.Created),
+			"stack", leak.Stack,
+		)
+	})
+}
+
+// connClosed reports the handles still open on conn
+func (d *LeakDetector) connClosed(conn *connInfo) {
+	if d == nil || conn == nil {
+		return
+	}
+
+	d.mu.Lock()
+	var open []*trackedHandle
+	for h := range d.open {
+		if h.conn == conn {
+			open = append(open, h)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, h := range open {
+		h.report(LeakReasonConnClosed)
+	}
+}
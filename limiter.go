@@ -0,0 +1,294 @@
+package instrumentedsql
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLimiterClasses is the number of query classes above which idle ones are pruned
+const maxLimiterClasses = 1024
+
+// QueryClassFunc returns the class of a call, such as the tenant or the kind of workload it belongs to,
+// see WithQueryClasses
+type QueryClassFunc func(ctx context.Context, call *Call) string
+
+// ClassByContextValue returns a QueryClassFunc classifying calls by the value stored under key in their context,
+// calls without one are of the empty class
+func ClassByContextValue(key interface{}) QueryClassFunc {
+	return func(ctx context.Context, call *Call) string {
+		if ctx == nil {
+			return ""
+		}
+
+		v := ctx.Value(key)
+		if v == nil {
+			return ""
+		}
+
+		return fmt.Sprint(v)
+	}
+}
+
+// queryLimiter holds the semaphores limiting the concurrent queries of a wrapped driver, one per query class
+type queryLimiter struct {
+	mu         sync.Mutex
+	semaphores map[string]*semaphore
+}
+
+// limiterSlot is the share of a semaphore held by a call, it is released once the call, and the rows it returns
+// if any, are done
+type limiterSlot struct {
+	limiter *queryLimiter
+	sem     *semaphore
+	weight  int
+	class   string
+	wait    time.Duration
+	once    sync.Once
+
+	// held is the slot taken by DB that the slot of a call made with its context stands for, see DB.waitSlot
+	held *limiterSlot
+	// claimed is set on a slot taken by DB once the rows of the query made with it hold it
+	claimed int32
+}
+
+type heldSlotKey struct{}
+
+func newQueryLimiter() *queryLimiter {
+	return &queryLimiter{semaphores: make(map[string]*semaphore)}
+}
+
+// acquireSlot waits for the call to be allowed to run within the limit of its class, labeling it with the time waited.
+// The wait is traced as OpSQLLimiterWait if the call cannot run right away.
+// It returns nil if no limit applies to call, and the context error if ctx is done before it is allowed to run.
+// Calls made with a context holding a slot taken by DB before waiting for a connection use it instead.
+func (o opts) acquireSlot(ctx context.Context, ic *Call) (*limiterSlot, error) {
+	if o.limiter == nil || o.MaxConcurrentQueries <= 0 && len(o.QueryClassLimits) == 0 {
+		return nil, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if held, ok := ctx.Value(heldSlotKey{}).(*limiterSlot); ok && held.limiter == o.limiter {
+		if held.class != "" {
+			ic.call.setLabel("limiter_class", held.class)
+		}
+		ic.call.setLabel("limiter_wait", held.wait.String())
+		return &limiterSlot{held: held}, nil
+	}
+
+	class := ""
+	if o.QueryClass != nil {
+		class = o.QueryClass(ctx, ic)
+	}
+	limit, ok := o.QueryClassLimits[class]
+	if !ok {
+		limit = o.MaxConcurrentQueries
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+	weight := 1
+	if o.QueryWeight != nil {
+		weight = o.QueryWeight(ctx, ic)
+	}
+	if weight < 1 {
+		weight = 1
+	} else if weight > limit {
+		weight = limit
+	}
+
+	if class != "" {
+		ic.call.setLabel("limiter_class", class)
+	}
+	sem := o.limiter.semaphore(class, limit)
+	if sem.tryAcquire(weight) {
+		ic.call.setLabel("limiter_wait", time.Duration(0).String())
+		return &limiterSlot{limiter: o.limiter, sem: sem, weight: weight, class: class}, nil
+	}
+
+	var wait *call
+	if !o.hasOpExcluded(OpSQLLimiterWait) {
+		wait = o.startCall(ctx, OpSQLLimiterWait)
+		if class != "" {
+			wait.setLabel("limiter_class", class)
+		}
+		wait.setLabel("limiter_limit", strconv.Itoa(limit))
+		wait.setLabel("limiter_weight", strconv.Itoa(weight))
+	}
+
+	start := time.Now()
+	err := sem.acquire(ctx, weight)
+	waited := time.Since(start)
+	ic.call.setLabel("limiter_wait", waited.String())
+	if wait != nil {
+		wait.finish(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &limiterSlot{limiter: o.limiter, sem: sem, weight: weight, class: class, wait: waited}, nil
+}
+
+// release releases the share of the semaphore held by the call, at most once.
+// The slot of a call standing for one taken by DB only releases it once claimed, DB releases it otherwise.
+func (s *limiterSlot) release() {
+	if s == nil {
+		return
+	}
+	if s.held != nil {
+		if atomic.LoadInt32(&s.held.claimed) == 1 {
+			s.held.release()
+		}
+		return
+	}
+
+	s.once.Do(func() {
+		s.sem.release(s.weight)
+	})
+}
+
+// claim makes the rows of a successful query release the slot taken by DB the slot of the query stands for,
+// rather than DB once the query returns
+func (s *limiterSlot) claim() {
+	if s != nil && s.held != nil {
+		atomic.StoreInt32(&s.held.claimed, 1)
+	}
+}
+
+// releaseUnclaimed releases a slot taken by DB, unless the rows of a query made with it claimed it
+func (s *limiterSlot) releaseUnclaimed() {
+	if s != nil && atomic.LoadInt32(&s.claimed) == 0 {
+		s.release()
+	}
+}
+
+// semaphore returns the semaphore of class, created with limit if it does not exist yet
+func (l *queryLimiter) semaphore(class string, limit int) *semaphore {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sem, ok := l.semaphores[class]
+	if ok {
+		return sem
+	}
+
+	if len(l.semaphores) >= maxLimiterClasses {
+		for c, idle := range l.semaphores {
+			if idle.idle() {
+				delete(l.semaphores, c)
+			}
+		}
+	}
+	sem = newSemaphore(limit)
+	l.semaphores[class] = sem
+
+	return sem
+}
+
+// semaphore is a weighted semaphore, waiters are served in order so that heavy calls are not starved by light ones
+type semaphore struct {
+	size int
+
+	mu      sync.Mutex
+	cur     int
+	waiters list.List
+}
+
+type semaphoreWaiter struct {
+	weight int
+	ready  chan struct{}
+}
+
+func newSemaphore(size int) *semaphore {
+	return &semaphore{size: size}
+}
+
+// tryAcquire acquires weight without waiting, it reports whether it succeeded
+func (s *semaphore) tryAcquire(weight int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size-s.cur < weight || s.waiters.Len() > 0 {
+		return false
+	}
+	s.cur += weight
+
+	return true
+}
+
+// acquire acquires weight, waiting until it is available or ctx is done
+func (s *semaphore) acquire(ctx context.Context, weight int) error {
+	s.mu.Lock()
+	if s.size-s.cur >= weight && s.waiters.Len() == 0 {
+		s.cur += weight
+		s.mu.Unlock()
+		return nil
+	}
+
+	w := semaphoreWaiter{weight: weight, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-w.ready:
+			// Acquired after all, give it back
+			s.cur -= weight
+			s.notifyWaiters()
+		default:
+			front := s.waiters.Front() == elem
+			s.waiters.Remove(elem)
+			if front {
+				// The waiters behind may fit now
+				s.notifyWaiters()
+			}
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// release releases weight and wakes the waiters which fit
+func (s *semaphore) release(weight int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cur -= weight
+	s.notifyWaiters()
+}
+
+// notifyWaiters wakes the waiters at the front of the queue for as long as they fit, s.mu must be held
+func (s *semaphore) notifyWaiters() {
+	for {
+		next := s.waiters.Front()
+		if next == nil {
+			return
+		}
+
+		w := next.Value.(semaphoreWaiter)
+		if s.size-s.cur < w.weight {
+			return
+		}
+		s.cur += w.weight
+		s.waiters.Remove(next)
+		close(w.ready)
+	}
+}
+
+// idle reports whether no call holds or waits for the semaphore
+func (s *semaphore) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cur == 0 && s.waiters.Len() == 0
+}
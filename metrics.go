@@ -0,0 +1,33 @@
+package instrumentedsql
+
+import "context"
+
+// Metrics is the interface needed to be implemented by any metrics implementation we use, see also MetricsFunc
+//
+// Durations are observed in seconds, the labels map must not be retained after Observe returns.
+type Metrics interface {
+	Observe(ctx context.Context, name string, value float64, labels map[string]string)
+}
+
+type nullMetrics struct{}
+
+func (nullMetrics) Observe(ctx context.Context, name string, value float64, labels map[string]string) {
+}
+
+// MetricsFunc is an adapter which allows a function to be used as a Metrics sink.
+type MetricsFunc func(ctx context.Context, name string, value float64, labels map[string]string)
+
+// Observe calls f(ctx, name, value, labels).
+func (f MetricsFunc) Observe(ctx context.Context, name string, value float64, labels map[string]string) {
+	f(ctx, name, value, labels)
+}
+
+// metricLabels returns a copy of the static labels, to be extended with labels specific to an observation
+func (o opts) metricLabels() map[string]string {
+	labels := make(map[string]string, len(o.Labels)+2)
+	for k, v := range o.Labels {
+		labels[k] = v
+	}
+
+	return labels
+}
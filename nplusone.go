@@ -0,0 +1,203 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luna-duclos/instrumentedsql/sqlclass"
+)
+
+const (
+	// nPlusOneWindow is how long the queries of a group are counted after its last query
+	nPlusOneWindow = time.Minute
+	// maxNPlusOneGroups is the maximum number of groups counted at once, stale ones are pruned and
+	// the least recently used one is evicted beyond it
+	maxNPlusOneGroups = 1024
+	// maxArgShapes is the number of distinct argument shapes sampled per statement
+	maxArgShapes = 3
+)
+
+// NPlusOneDetector counts how many times the same normalized statement is executed or queried within a group
+// of calls, such as those made for a single request, and reports statements which run more often than a threshold,
+// a typical sign of N+1 queries. Use WithNPlusOneDetector to enable it.
+//
+// A statement is reported once per group, through the logger under OpSQLNPlusOne with a sample of the types
+// of its arguments, and as the n_plus_one label on the span contained in the context of the call.
+type NPlusOneDetector struct {
+	threshold int
+	groupKey  func(ctx context.Context) interface{}
+
+	mu     sync.Mutex
+	groups map[interface{}]*nPlusOneGroup
+}
+
+type nPlusOneGroup struct {
+	statements map[string]*nPlusOneStatement
+	at         time.Time
+}
+
+type nPlusOneStatement struct {
+	count     int
+	argShapes []string
+	reported  bool
+}
+
+// NewNPlusOneDetector returns a detector reporting statements which run more than threshold times in a group.
+// Calls made with a context returned by WithNPlusOneGroup are grouped within it. Otherwise, groupKey returns
+// the key grouping the calls made with a context, such as a request ID stored in it, calls for which it returns nil
+// or a key which is not comparable are not counted. If groupKey is nil, only calls within a WithNPlusOneGroup
+// are counted: spans are not used as groups, as tracers return a shared placeholder span for calls without
+// a parent, which would count background jobs as a single group.
+func NewNPlusOneDetector(threshold int, groupKey func(ctx context.Context) interface{}) *NPlusOneDetector {
+	return &NPlusOneDetector{
+		threshold: threshold,
+		groupKey:  groupKey,
+		groups:    make(map[interface{}]*nPlusOneGroup),
+	}
+}
+
+type nPlusOneGroupKey struct{}
+
+// nPlusOneScope is the key of a group started with WithNPlusOneGroup, it is not empty so that each one has
+// an address of its own
+type nPlusOneScope struct {
+	_ byte
+}
+
+// WithNPlusOneGroup returns a context whose calls, and those of the contexts derived from it, are counted as a
+// group of their own by every NPlusOneDetector, such as the calls made for a single request
+func WithNPlusOneGroup(ctx context.Context) context.Context {
+	return context.WithValue(ctx, nPlusOneGroupKey{}, &nPlusOneScope{})
+}
+
+// GroupByContextValue returns a group key for NewNPlusOneDetector grouping calls by the value stored under key
+// in their context
+func GroupByContextValue(key interface{}) func(ctx context.Context) interface{} {
+	return func(ctx context.Context) interface{} {
+		return ctx.Value(key)
+	}
+}
+
+// detectNPlusOne counts call in its group, reporting its statement if it ran more than the threshold
+func (o opts) detectNPlusOne(ctx context.Context, call *Call) {
+	d := o.NPlusOneDetector
+	if d == nil || ctx == nil {
+		return
+	}
+
+	switch call.Op {
+	case OpSQLConnExec, OpSQLConnQuery, OpSQLStmtExec, OpSQLStmtQuery:
+	default:
+		return
+	}
+
+	var key interface{}
+	if scope, ok := ctx.Value(nPlusOneGroupKey{}).(*nPlusOneScope); ok {
+		key = scope
+	} else if d.groupKey != nil {
+		key = d.groupKey(ctx)
+	}
+	if key == nil || !reflect.TypeOf(key).Comparable() {
+		return
+	}
+
+	query := sqlclass.Normalize(call.Query)
+	count, shapes, report := d.count(key, query, argShape(call.Args))
+	if !report {
+		return
+	}
+
+	o.GetSpan(ctx).SetLabel("n_plus_one", query)
+	o.Log(ctx, OpSQLNPlusOne,
+		"query", query,
+		"count", strconv.Itoa(count),
+		"threshold", strconv.Itoa(d.threshold),
+		"arg_shapes", strings.Join(shapes, " "),
+	)
+}
+
+// count counts a run of query in the group of key, it reports whether the statement is to be reported
+func (d *NPlusOneDetector) count(key interface{}, query, shape string) (int, []string, bool) {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	group, ok := d.groups[key]
+	if !ok {
+		if len(d.groups) >= maxNPlusOneGroups {
+			d.prune(now)
+		}
+		group = &nPlusOneGroup{statements: make(map[string]*nPlusOneStatement)}
+		d.groups[key] = group
+	}
+	group.at = now
+
+	stmt, ok := group.statements[query]
+	if !ok {
+		stmt = &nPlusOneStatement{}
+		group.statements[query] = stmt
+	}
+	stmt.count++
+	if len(stmt.argShapes) < maxArgShapes && !containsString(stmt.argShapes, shape) {
+		stmt.argShapes = append(stmt.argShapes, shape)
+	}
+
+	if stmt.reported || stmt.count <= d.threshold {
+		return stmt.count, nil, false
+	}
+	stmt.reported = true
+
+	return stmt.count, append([]string(nil), stmt.argShapes...), true
+}
+
+// prune forgets the groups without calls within the window, or the least recently used one if all had some,
+// d.mu must be held
+func (d *NPlusOneDetector) prune(now time.Time) {
+	var lru interface{}
+	var lruAt time.Time
+	for k, group := range d.groups {
+		if now.Sub(group.at) > nPlusOneWindow {
+			delete(d.groups, k)
+		} else if lru == nil || group.at.Before(lruAt) {
+			lru, lruAt = k, group.at
+		}
+	}
+
+	if len(d.groups) >= maxNPlusOneGroups {
+		delete(d.groups, lru)
+	}
+}
+
+// argShape describes the types of args, such as {int64, string}
+func argShape(args []driver.NamedValue) string {
+	types := make([]string, len(args))
+	for i, arg := range args {
+		if arg.Value == nil {
+			types[i] = "nil"
+		} else {
+			types[i] = fmt.Sprintf("%T", arg.Value)
+		}
+		if arg.Name != "" {
+			types[i] = arg.Name + "=" + types[i]
+		}
+	}
+
+	return "{" + strings.Join(types, ", ") + "}"
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// mapSpan is a span recording its labels
+type mapSpan struct {
+	labels map[string]string
+}
+
+func (s mapSpan) NewChild(string) Span         { return s }
+func (s mapSpan) SetLabel(k, v string)         { s.labels[k] = v }
+func (s mapSpan) SetError(err error)           {}
+func (s mapSpan) Finish()                      {}
+func (s mapSpan) GetSpan(context.Context) Span { return s }
+
+func TestNPlusOneGroup(t *testing.T) {
+	span := mapSpan{labels: make(map[string]string)}
+	d := NewNPlusOneDetector(2, nil)
+	o := opts{Logger: nullLogger{}, Tracer: span, NPlusOneDetector: d}
+	query := "SELECT * FROM users WHERE id = ?"
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		o.detectNPlusOne(ctx, &Call{Op: OpSQLConnQuery, Query: query, Args: []driver.NamedValue{{Ordinal: 1, Value: int64(i)}}})
+	}
+	if _, ok := span.labels["n_plus_one"]; ok {
+		t.Error("expected calls outside a group not to be counted")
+	}
+
+	ctx = WithNPlusOneGroup(ctx)
+	for i := 0; i < 3; i++ {
+		o.detectNPlusOne(ctx, &Call{Op: OpSQLConnQuery, Query: query, Args: []driver.NamedValue{{Ordinal: 1, Value: int64(i)}}})
+	}
+	if span.labels["n_plus_one"] != query {
+		t.Errorf("expected the statement to be reported within the group, got labels %v", span.labels)
+	}
+}
+
+func TestNPlusOneGroupsBound(t *testing.T) {
+	d := NewNPlusOneDetector(2, nil)
+	for i := 0; i < 2*maxNPlusOneGroups; i++ {
+		d.count(fmt.Sprint(i), "SELECT 1", "{}")
+	}
+	if len(d.groups) > maxNPlusOneGroups {
+		t.Errorf("expected at most %d groups, got %d", maxNPlusOneGroups, len(d.groups))
+	}
+	if _, ok := d.groups[fmt.Sprint(2*maxNPlusOneGroups-1)]; !ok {
+		t.Error("expected the most recent group to be kept")
+	}
+
+	d.groups["stale"] = &nPlusOneGroup{statements: make(map[string]*nPlusOneStatement), at: time.Now().Add(-2 * nPlusOneWindow)}
+	d.count("new", "SELECT 1", "{}")
+	if _, ok := d.groups["stale"]; ok {
+		t.Error("expected stale groups to be pruned")
+	}
+}
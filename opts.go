@@ -1,10 +1,49 @@
 package instrumentedsql
 
+import (
+	"context"
+	"time"
+)
+
 type opts struct {
 	Logger
 	Tracer
-	OpsExcluded map[string]struct{}
-	OmitArgs    bool
+	Metrics
+	OpsExcluded          map[string]struct{}
+	OmitArgs             bool
+	ErrorClassifiers     []ErrorClassifier
+	IgnoreContextErrors  bool
+	IgnoredErrors        []error
+	ErrorFilter          ErrorFilter
+	CollapseFallback     bool
+	ServerConnID         ServerConnIDFunc
+	Labels               map[string]string
+	StmtCacheSize        int
+	LeakDetector         *LeakDetector
+	FaultInjector        FaultInjector
+	QueryRecorder        *QueryRecorder
+	Interceptors         []Interceptor
+	QueryRewriter        QueryRewriter
+	ReadOnly             bool
+	NPlusOneDetector     *NPlusOneDetector
+	OpTimeouts           map[string]time.Duration
+	CircuitBreaker       *CircuitBreaker
+	MaxConcurrentQueries int
+	QueryClass           QueryClassFunc
+	QueryClassLimits     map[string]int
+	QueryWeight          func(ctx context.Context, call *Call) int
+	AuditSink            AuditSink
+	AuditFailures        bool
+	AuditRequired        bool
+	AuditArgRedactor     AuditArgRedactor
+	Explain              ExplainFunc
+	ExplainThreshold     time.Duration
+	ExplainInterval      time.Duration
+	retries              *retryTracker
+	limiter              *queryLimiter
+	explainer            *explainLimiter
+	// conn identifies the connection, it is only set on the opts of a wrappedConn and the objects it creates
+	conn *connInfo
 }
 
 // Opt is a functional option type for the wrapped driver
@@ -53,3 +92,256 @@ func WithIncludeArgs() Opt {
 		o.OmitArgs = false
 	}
 }
+
+// WithMetrics sets the metrics sink of the wrapped driver to the provided sink
+// Every instrumented call observes its duration under the name of its op
+func WithMetrics(m Metrics) Opt {
+	return func(o *opts) {
+		o.Metrics = m
+	}
+}
+
+// WithErrorClassifiers adds driver specific classifiers, such as PostgresErrorClassifier, used to categorize errors
+// Classifiers are consulted in order, the first one returning a non-empty category wins
+func WithErrorClassifiers(classifiers ...ErrorClassifier) Opt {
+	return func(o *opts) {
+		o.ErrorClassifiers = append(o.ErrorClassifiers, classifiers...)
+	}
+}
+
+// WithIgnoreContextErrors will make it so that calls failing because their context was cancelled or its deadline exceeded
+// do not mark their span as failed. Such calls are always labeled with a status of either cancelled or deadline_exceeded.
+// Calls failing with a TimeoutError are still failures, as the timeout was enforced by the wrapped driver rather than
+// by the caller.
+func WithIgnoreContextErrors() Opt {
+	return func(o *opts) {
+		o.IgnoreContextErrors = true
+	}
+}
+
+// WithErrorFilter sets the filter deciding which errors are expected and should not be treated as failures,
+// replacing DefaultErrorFilter. Filters wanting to extend the default behaviour can call DefaultErrorFilter themselves.
+func WithErrorFilter(filter ErrorFilter) Opt {
+	return func(o *opts) {
+		o.ErrorFilter = filter
+	}
+}
+
+// WithIgnoredErrors adds sentinel errors which are never treated as failures, whichever op returns them
+func WithIgnoredErrors(errs ...error) Opt {
+	return func(o *opts) {
+		o.IgnoredErrors = append(o.IgnoredErrors, errs...)
+	}
+}
+
+// WithCollapsedFallback will make it so that when database/sql falls back to prepare and exec, because the wrapped
+// driver does not implement ExecerContext or QueryerContext, the fallback is traced as a single span named after the
+// original op instead of separate prepare, exec and close spans. The prepare and close are still logged.
+func WithCollapsedFallback() Opt {
+	return func(o *opts) {
+		o.CollapseFallback = true
+	}
+}
+
+// WithServerConnID sets a function fetching the server side ID of every new connection, such as PostgresServerConnID,
+// which is attached to spans and log lines alongside the connection ID assigned by the wrapper.
+func WithServerConnID(f ServerConnIDFunc) Opt {
+	return func(o *opts) {
+		o.ServerConnID = f
+	}
+}
+
+// WithLabels sets labels describing the database, such as db.system or db.instance, which are attached to every span,
+// log line and metric produced by the wrapped driver, including the pool statistics published by a StatsExporter
+func WithLabels(labels map[string]string) Opt {
+	return func(o *opts) {
+		o.Labels = make(map[string]string, len(labels))
+		for k, v := range labels {
+			o.Labels[k] = v
+		}
+	}
+}
+
+// WithStmtCache enables a per connection cache of up to size prepared statements, keyed by query.
+// ExecContext and QueryContext calls on the connection then run through a cached statement, prepared on first use,
+// which saves a round-trip for drivers that do not cache statements themselves.
+// The least recently used statement is closed when the cache is full, all of them are closed with the connection.
+func WithStmtCache(size int) Opt {
+	return func(o *opts) {
+		o.StmtCacheSize = size
+	}
+}
+
+// WithLeakDetector makes the wrapped driver track every statement and rows handle it hands out with the passed detector,
+// which reports those that are not closed in time. Tracking records a stack trace per handle, it is meant for tests.
+func WithLeakDetector(d *LeakDetector) Opt {
+	return func(o *opts) {
+		o.LeakDetector = d
+	}
+}
+
+// WithFaultInjector sets an injector which is consulted before every instrumented call is forwarded to the wrapped driver,
+// and can delay it, fail it or drop its result. Injected faults are labeled on spans and logs with fault and fault_delay.
+// This is meant for chaos testing retry and circuit breaking logic, see also NewFaultRules.
+func WithFaultInjector(injector FaultInjector) Opt {
+	return func(o *opts) {
+		o.FaultInjector = injector
+	}
+}
+
+// WithQueryRecorder records every instrumented call, with its query, arguments and results, to the passed recorder.
+// Arguments are recorded regardless of WithOmitArgs, calls of excluded ops are not recorded.
+// The recording can be replayed in tests with instrumentedsqltest.NewReplayDriver.
+func WithQueryRecorder(r *QueryRecorder) Opt {
+	return func(o *opts) {
+		o.QueryRecorder = r
+	}
+}
+
+// WithInterceptor appends an interceptor to the chain every call made through the wrapped driver passes along.
+// Interceptors run in the order they are added, after the built-in TracingInterceptor, LoggingInterceptor
+// and MetricsInterceptor, unless the chain is set with WithInterceptors.
+func WithInterceptor(i Interceptor) Opt {
+	return func(o *opts) {
+		o.Interceptors = append(o.Interceptors[:len(o.Interceptors):len(o.Interceptors)], i)
+	}
+}
+
+// WithInterceptors replaces the interceptor chain, built-in interceptors included, so that their order is explicit.
+// Built-in interceptors left out of the chain are disabled.
+func WithInterceptors(chain ...Interceptor) Opt {
+	return func(o *opts) {
+		o.Interceptors = append([]Interceptor(nil), chain...)
+	}
+}
+
+// WithQueryRewriter sets a function rewriting the queries prepared, executed and queried on connections
+// before they are passed along the interceptor chain to the wrapped driver.
+// Rewritten queries are labeled as query, with the query as passed to database/sql labeled as original_query.
+func WithQueryRewriter(rewriter QueryRewriter) Opt {
+	return func(o *opts) {
+		o.QueryRewriter = rewriter
+	}
+}
+
+// WithReadOnly restricts every call made through the wrapped driver to reads, as ReadOnly does for a context.
+// Queries which are not known to only read, such as INSERT, UPDATE, DELETE and DDL statements, and transactions
+// which are not read-only are rejected with a ReadOnlyError before they reach the database.
+func WithReadOnly() Opt {
+	return func(o *opts) {
+		o.ReadOnly = true
+	}
+}
+
+// WithNPlusOneDetector makes the wrapped driver count the statements executed and queried with the passed detector,
+// which reports those running more often than its threshold within a request
+func WithNPlusOneDetector(d *NPlusOneDetector) Opt {
+	return func(o *opts) {
+		o.NPlusOneDetector = d
+	}
+}
+
+// WithOpTimeouts sets the timeouts enforced on calls of the passed ops, such as OpSQLConnQuery, unless their context
+// has a tighter deadline. Timeouts apply to OpSQLPrepare, OpSQLConnExec, OpSQLConnQuery, OpSQLStmtExec and OpSQLStmtQuery,
+// for queries until their rows are closed. Calls exceeding their timeout fail with a TimeoutError and are labeled
+// with timeout_enforced. See also WithSQLBudget.
+func WithOpTimeouts(timeouts map[string]time.Duration) Opt {
+	return func(o *opts) {
+		o.OpTimeouts = make(map[string]time.Duration, len(timeouts))
+		for op, timeout := range timeouts {
+			o.OpTimeouts[op] = timeout
+		}
+	}
+}
+
+// WithCircuitBreaker guards the calls connecting, preparing, executing and querying with the provided circuit breaker.
+// The same breaker can be passed to several wrapped drivers connecting to the same database.
+func WithCircuitBreaker(b *CircuitBreaker) Opt {
+	return func(o *opts) {
+		o.CircuitBreaker = b
+	}
+}
+
+// WithMaxConcurrentQueries limits to n the queries running at once through the wrapped driver, a query running
+// from when it is executed until its rows are closed. Queries over the limit wait for their turn, in order,
+// or until their context is done. Their wait is traced as OpSQLLimiterWait and labeled as limiter_wait on the query.
+// Beware that a goroutine running a query while holding the rows of another may wait on itself, and that queries
+// wait while holding the connection database/sql handed them, unless made through the ExecContext, QueryContext
+// and QueryRowContext of a DB, which wait before taking a connection. Use DB so that queued queries do not starve
+// the pool.
+func WithMaxConcurrentQueries(n int) Opt {
+	return func(o *opts) {
+		o.MaxConcurrentQueries = n
+	}
+}
+
+// WithQueryClasses splits the limit set with WithMaxConcurrentQueries by the class of the queries,
+// such as their tenant or workload, so that the queries of one class do not starve those of the others.
+// Each class is limited to limits[class] if set, to the limit set with WithMaxConcurrentQueries otherwise,
+// a limit of zero leaving the class unlimited.
+func WithQueryClasses(class QueryClassFunc, limits map[string]int) Opt {
+	return func(o *opts) {
+		o.QueryClass = class
+		o.QueryClassLimits = make(map[string]int, len(limits))
+		for c, limit := range limits {
+			o.QueryClassLimits[c] = limit
+		}
+	}
+}
+
+// WithQueryWeight sets how many of the slots of its class a query takes, one by default,
+// so that costly queries such as reports can be weighted more than the others
+func WithQueryWeight(weight func(ctx context.Context, call *Call) int) Opt {
+	return func(o *opts) {
+		o.QueryWeight = weight
+	}
+}
+
+// WithAuditSink writes an AuditRecord to the provided sink for every statement which succeeds and is not read-only,
+// such as INSERT, UPDATE, DELETE and DDL, and for the end of every transaction containing one.
+// Auditing is not affected by WithOpsExcluded. Only the types of the arguments are included unless
+// WithAuditArgRedactor is used, and none with WithOmitArgs. Errors writing records are logged under OpSQLAudit,
+// use WithAuditRequired to also fail the calls with them.
+// Sinks implementing a Flush() error method are flushed when the wrapped connector is closed.
+func WithAuditSink(sink AuditSink) Opt {
+	return func(o *opts) {
+		o.AuditSink = sink
+	}
+}
+
+// WithAuditFailures also audits the statements which fail, along with their error
+func WithAuditFailures() Opt {
+	return func(o *opts) {
+		o.AuditFailures = true
+	}
+}
+
+// WithAuditRequired fails the audited statements whose record the audit sink fails to write with an AuditError,
+// instead of only logging the error. The statement has run by then: within a transaction, the caller can roll it
+// back on the error, outside of one the change is already made. Commits and rollbacks, which have taken effect by
+// then, are not failed.
+func WithAuditRequired() Opt {
+	return func(o *opts) {
+		o.AuditRequired = true
+	}
+}
+
+// WithAuditArgRedactor sets which argument values are included in audit records, and how they are redacted
+func WithAuditArgRedactor(redactor AuditArgRedactor) Opt {
+	return func(o *opts) {
+		o.AuditArgRedactor = redactor
+	}
+}
+
+// WithSlowQueryExplain explains the queries which take longer than threshold with explain, such as PostgresExplain,
+// on the connection they ran on once it is free again, and records their plan as an OpSQLExplain call.
+// At most one query is explained per interval, and each statement at most once in ten minutes.
+// Only SELECT, INSERT, UPDATE, DELETE and REPLACE statements are explained, outside of transactions.
+// Queries are timed until they return their rows, not until the rows are read.
+func WithSlowQueryExplain(threshold time.Duration, explain ExplainFunc, interval time.Duration) Opt {
+	return func(o *opts) {
+		o.Explain = explain
+		o.ExplainThreshold = threshold
+		o.ExplainInterval = interval
+	}
+}
@@ -0,0 +1,63 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+type readOnlyKey struct{}
+
+// ReadOnly returns a context in which the calls made through any wrapped driver are restricted to reads,
+// see WithReadOnly for what is rejected
+func ReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyKey{}, true)
+}
+
+// IsReadOnly reports whether ctx was marked as read-only with ReadOnly
+func IsReadOnly(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+
+	readOnly, _ := ctx.Value(readOnlyKey{}).(bool)
+	return readOnly
+}
+
+// ReadOnlyError is returned for calls rejected because they would write through a read-only context or driver
+type ReadOnlyError struct {
+	Op string
+	// Query is the rejected query, it is empty for transactions which are not read-only
+	Query string
+}
+
+func (e *ReadOnlyError) Error() string {
+	if e.Query == "" {
+		return "instrumentedsql: " + e.Op + " rejected, transaction is not read-only"
+	}
+
+	return "instrumentedsql: " + e.Op + " rejected, query is not read-only: " + e.Query
+}
+
+// isReadOnly reports whether calls with ctx are restricted to reads
+func (o opts) isReadOnly(ctx context.Context) bool {
+	return o.ReadOnly || IsReadOnly(ctx)
+}
+
+// guardQuery returns a ReadOnlyError if the query of call writes while calls with ctx are restricted to reads
+func (o opts) guardQuery(ctx context.Context, call *Call) error {
+	if !o.isReadOnly(ctx) || call.Statement().ReadOnly() {
+		return nil
+	}
+
+	return &ReadOnlyError{Op: call.Op, Query: call.Query}
+}
+
+// guardTx returns a ReadOnlyError if a transaction which is not read-only is begun while calls with ctx are
+// restricted to reads
+func (o opts) guardTx(ctx context.Context, call *Call, txOpts driver.TxOptions) error {
+	if !o.isReadOnly(ctx) || txOpts.ReadOnly {
+		return nil
+	}
+
+	return &ReadOnlyError{Op: call.Op}
+}
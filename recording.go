@@ -0,0 +1,295 @@
+package instrumentedsql
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// RecordedCall is a call captured by a QueryRecorder
+type RecordedCall struct {
+	Op    string        `json:"op"`
+	Query string        `json:"query,omitempty"`
+	Args  []RecordedArg `json:"args,omitempty"`
+	// Columns and Rows are the result set of query ops, as far as it was read by the caller
+	Columns []string          `json:"columns,omitempty"`
+	Rows    [][]RecordedValue `json:"rows,omitempty"`
+	// LastInsertID and RowsAffected are the result of exec ops, if supported by the driver
+	LastInsertID *int64 `json:"last_insert_id,omitempty"`
+	RowsAffected *int64 `json:"rows_affected,omitempty"`
+	Err          string `json:"err,omitempty"`
+	// RowsErr is the error reading the result set ended with, other than io.EOF
+	RowsErr  string        `json:"rows_err,omitempty"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+}
+
+// RecordedArg is a query argument captured by a QueryRecorder
+type RecordedArg struct {
+	Name    string        `json:"name,omitempty"`
+	Ordinal int           `json:"ordinal"`
+	Value   RecordedValue `json:"value"`
+}
+
+// RecordedValue is a driver.Value whose JSON representation preserves its type
+type RecordedValue struct {
+	driver.Value
+}
+
+type recordedValueJSON struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// MarshalJSON encodes the value along with its type
+func (v RecordedValue) MarshalJSON() ([]byte, error) {
+	var typ string
+	switch v.Value.(type) {
+	case nil:
+		return json.Marshal(recordedValueJSON{Type: "null"})
+	case int64:
+		typ = "int64"
+	case float64:
+		typ = "float64"
+	case bool:
+		typ = "bool"
+	case []byte:
+		typ = "bytes"
+	case string:
+		typ = "string"
+	case time.Time:
+		typ = "time"
+	default:
+		// Not a driver.Value, as is the case for arguments the driver converts itself
+		return json.Marshal(recordedValueJSON{Type: "string", Value: mustMarshal(fmt.Sprint(v.Value))})
+	}
+
+	value, err := json.Marshal(v.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(recordedValueJSON{Type: typ, Value: value})
+}
+
+// UnmarshalJSON decodes a value encoded by MarshalJSON
+func (v *RecordedValue) UnmarshalJSON(data []byte) error {
+	var raw recordedValueJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var err error
+	switch raw.Type {
+	case "null":
+		v.Value = nil
+	case "int64":
+		var i int64
+		err = json.Unmarshal(raw.Value, &i)
+		v.Value = i
+	case "float64":
+		var f float64
+		err = json.Unmarshal(raw.Value, &f)
+		v.Value = f
+	case "bool":
+		var b bool
+		err = json.Unmarshal(raw.Value, &b)
+		v.Value = b
+	case "bytes":
+		var b []byte
+		err = json.Unmarshal(raw.Value, &b)
+		v.Value = b
+	case "string":
+		var s string
+		err = json.Unmarshal(raw.Value, &s)
+		v.Value = s
+	case "time":
+		var t time.Time
+		err = json.Unmarshal(raw.Value, &t)
+		v.Value = t
+	default:
+		err = fmt.Errorf("instrumentedsql: unknown recorded value type %q", raw.Type)
+	}
+
+	return err
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// QueryRecorder writes every call flowing through a wrapped driver to a writer as JSON lines,
+// in a format that can be read back with ReadRecordings. See WithQueryRecorder.
+//
+// Query calls are written once their rows are closed, so that the result set can be included.
+type QueryRecorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewQueryRecorder returns a QueryRecorder writing to w, which is not closed by the recorder
+func NewQueryRecorder(w io.Writer) *QueryRecorder {
+	return &QueryRecorder{enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error encountered writing a call, after which no further calls are written
+func (r *QueryRecorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+func (r *QueryRecorder) write(call *RecordedCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(call)
+}
+
+// ReadRecordings reads the calls written by a QueryRecorder
+func ReadRecordings(r io.Reader) ([]RecordedCall, error) {
+	var calls []RecordedCall
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var call RecordedCall
+		if err := json.Unmarshal(scanner.Bytes(), &call); err != nil {
+			return nil, err
+		}
+		calls = append(calls, call)
+	}
+
+	return calls, scanner.Err()
+}
+
+// recordArgs converts query arguments, which are either []driver.Value or []driver.NamedValue
+func recordArgs(args interface{}) []RecordedArg {
+	var recorded []RecordedArg
+	switch args := args.(type) {
+	case []driver.NamedValue:
+		for _, arg := range args {
+			recorded = append(recorded, RecordedArg{Name: arg.Name, Ordinal: arg.Ordinal, Value: RecordedValue{arg.Value}})
+		}
+	case []driver.Value:
+		for i, arg := range args {
+			recorded = append(recorded, RecordedArg{Ordinal: i + 1, Value: RecordedValue{arg}})
+		}
+	}
+
+	return recorded
+}
+
+// recording is a call being recorded, it is written once the call finishes or, for queries, once its rows are closed
+type recording struct {
+	recorder *QueryRecorder
+	call     RecordedCall
+	// rows is set once rows are returned by the call, deferring the write to their close
+	rows bool
+	once sync.Once
+}
+
+func (r *recording) write() {
+	if r == nil {
+		return
+	}
+
+	r.once.Do(func() {
+		r.recorder.write(&r.call)
+	})
+}
+
+// startRecording starts recording c, rows.Next calls are recorded as part of their query instead
+func (c *call) startRecording() {
+	if c.QueryRecorder == nil || c.op == OpSQLRowsNext {
+		return
+	}
+
+	c.recording = &recording{recorder: c.QueryRecorder, call: RecordedCall{Op: c.op, Start: c.start}}
+}
+
+// recordResult adds the result of an exec op to the recording
+func (c *call) recordResult(res driver.Result) {
+	if c == nil || c.recording == nil {
+		return
+	}
+
+	if wrapped, ok := res.(wrappedResult); ok {
+		// Avoid tracing the calls made to record the result
+		res = wrapped.parent
+	}
+	if id, err := res.LastInsertId(); err == nil {
+		c.recording.call.LastInsertID = &id
+	}
+	if n, err := res.RowsAffected(); err == nil {
+		c.recording.call.RowsAffected = &n
+	}
+}
+
+// recordRows adds the columns of rows returned by a query op to the recording, and returns the recording the rows
+// are to add themselves to
+func (c *call) recordRows(rows driver.Rows) *recording {
+	if c == nil || c.recording == nil {
+		return nil
+	}
+
+	c.recording.call.Columns = rows.Columns()
+	c.recording.rows = true
+
+	return c.recording
+}
+
+// finishRecording writes the recording of c, unless it is a query whose rows are still to be read
+func (c *call) finishRecording(err error) {
+	if c == nil || c.recording == nil {
+		return
+	}
+
+	c.recording.call.Duration = time.Since(c.start)
+	if err != nil {
+		c.recording.call.Err = err.Error()
+	}
+	if err != nil || !c.recording.rows {
+		c.recording.write()
+	}
+}
+
+// addRow adds a row read from the result set to the recording
+func (r *recording) addRow(dest []driver.Value) {
+	if r == nil {
+		return
+	}
+
+	row := make([]RecordedValue, len(dest))
+	for i, v := range dest {
+		if b, ok := v.([]byte); ok {
+			// Drivers may reuse the buffer for the next row
+			v = append([]byte(nil), b...)
+		}
+		row[i] = RecordedValue{v}
+	}
+	r.call.Rows = append(r.call.Rows, row)
+}
+
+// rowsEnded records the error reading the result set ended with, unless it is io.EOF
+func (r *recording) rowsEnded(err error) {
+	if r == nil || err == io.EOF {
+		return
+	}
+
+	r.call.RowsErr = err.Error()
+}
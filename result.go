@@ -3,7 +3,6 @@ package instrumentedsql
 import (
 	"context"
 	"database/sql/driver"
-	"time"
 )
 
 type wrappedResult struct {
@@ -13,31 +12,19 @@ type wrappedResult struct {
 }
 
 func (r wrappedResult) LastInsertId() (id int64, err error) {
-	if !r.hasOpExcluded(OpSQLResLastInsertID) {
-		span := r.GetSpan(r.ctx).NewChild(OpSQLResLastInsertID)
-		span.SetLabel("component", "database/sql")
-		start := time.Now()
-		defer func() {
-			span.SetError(err)
-			span.Finish()
-			r.Log(r.ctx, OpSQLResLastInsertID, "err", err, "duration", time.Since(start))
-		}()
-	}
+	err = r.intercept(r.ctx, &Call{Op: OpSQLResLastInsertID}, func(ctx context.Context) (err error) {
+		id, err = r.parent.LastInsertId()
+		return err
+	})
 
-	return r.parent.LastInsertId()
+	return id, err
 }
 
 func (r wrappedResult) RowsAffected() (num int64, err error) {
-	if !r.hasOpExcluded(OpSQLResRowsAffected) {
-		span := r.GetSpan(r.ctx).NewChild(OpSQLResRowsAffected)
-		span.SetLabel("component", "database/sql")
-		start := time.Now()
-		defer func() {
-			span.SetError(err)
-			span.Finish()
-			r.Log(r.ctx, OpSQLResRowsAffected, "err", err, "duration", time.Since(start))
-		}()
-	}
+	err = r.intercept(r.ctx, &Call{Op: OpSQLResRowsAffected}, func(ctx context.Context) (err error) {
+		num, err = r.parent.RowsAffected()
+		return err
+	})
 
-	return r.parent.RowsAffected()
-}
\ No newline at end of file
+	return num, err
+}
@@ -0,0 +1,175 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBadConnRetries is the number of attempts database/sql makes on a cached or new connection when they fail
+	// with driver.ErrBadConn, before a last attempt on a new connection whose error it returns
+	maxBadConnRetries = 2
+	// retryWindow is how long a failed call is remembered while waiting for database/sql to retry it,
+	// which it does right away
+	retryWindow = 5 * time.Second
+	// maxPendingRetries is the maximum number of calls remembered at once
+	maxPendingRetries = 1024
+)
+
+// retryTracker remembers calls which database/sql is about to retry, or fall back from,
+// so that the next attempt of the same logical operation can be annotated as such.
+// database/sql passes the same context to every attempt it retries, which ties them together unless the context is
+// shared by concurrent calls, as context.Background() and context.TODO() are, whose retries are not tracked.
+// It falls back on the connection the call was made on, which ties the fallback to the call.
+type retryTracker struct {
+	mu      sync.Mutex
+	pending map[retryKey]pendingRetry
+}
+
+// retryKey is the key of a call remembered for its retry, by context, or for its fallback, by connection
+type retryKey struct {
+	ctx   context.Context
+	conn  *connInfo
+	op    string
+	query string
+}
+
+type pendingRetry struct {
+	attempt int
+	at      time.Time
+}
+
+// attempt describes a single attempt of a logical operation
+type attempt struct {
+	tracker *retryTracker
+	// key is the key of the attempt if its retries are tracked
+	key retryKey
+	// fallbackKey is the key of the attempt if its fallback is tracked
+	fallbackKey retryKey
+	number      int
+	fallbackOp  string
+	// inTx is set for attempts made within a transaction, which database/sql does not retry
+	inTx bool
+}
+
+func newRetryTracker() *retryTracker {
+	return &retryTracker{pending: make(map[retryKey]pendingRetry)}
+}
+
+// startAttempt returns the attempt for a call of op on the connection, see retryTracker.start
+func (o opts) startAttempt(ctx context.Context, op, query string) attempt {
+	a := o.retries.start(ctx, o.conn, op, query)
+	if id, _ := o.conn.tx(); id != "" {
+		a.inTx = true
+	}
+
+	return a
+}
+
+// start returns the attempt for a call of op on conn, looking up whether it retries or falls back from an earlier call
+func (t *retryTracker) start(ctx context.Context, conn *connInfo, op, query string) attempt {
+	a := attempt{tracker: t, number: 1}
+	if t == nil {
+		return a
+	}
+	if ctx != nil && !sharedContext(ctx) && reflect.TypeOf(ctx).Comparable() {
+		a.key = retryKey{ctx: ctx, op: op, query: query}
+	}
+	if conn != nil {
+		a.fallbackKey = retryKey{conn: conn, op: op, query: query}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, ok := t.pending[a.key]; ok && a.key.ctx != nil {
+		delete(t.pending, a.key)
+		a.number = p.attempt + 1
+	}
+
+	// database/sql falls back to prepare and execute when ExecerContext or QueryerContext return driver.ErrSkip
+	if op == OpSQLPrepare && conn != nil {
+		for _, fallbackOp := range []string{OpSQLConnExec, OpSQLConnQuery} {
+			key := retryKey{conn: conn, op: fallbackOp, query: query}
+			if _, ok := t.pending[key]; ok {
+				delete(t.pending, key)
+				a.fallbackOp = fallbackOp
+				break
+			}
+		}
+	}
+
+	return a
+}
+
+// sharedContext reports whether ctx is one of the contexts shared by unrelated calls
+func sharedContext(ctx context.Context) bool {
+	return ctx == context.Background() || ctx == context.TODO()
+}
+
+// mayRetry reports whether err may make database/sql retry the attempt on another connection, it does not for calls
+// made through a *sql.Conn, which the driver cannot tell apart, nor within transactions or after the attempt it
+// makes on a new connection
+func (a attempt) mayRetry(err error) bool {
+	return isBadConn(err) && a.key.ctx != nil && a.number <= maxBadConnRetries && !a.inTx
+}
+
+// isBadConn reports whether err is or wraps driver.ErrBadConn, as database/sql checks before retrying
+func isBadConn(err error) bool {
+	for ; err != nil; err = unwrapError(err) {
+		if err == driver.ErrBadConn {
+			return true
+		}
+	}
+
+	return false
+}
+
+// done remembers the attempt if err will make database/sql retry or fall back
+func (a attempt) done(err error) {
+	if a.tracker == nil {
+		return
+	}
+
+	switch {
+	case a.mayRetry(err):
+		a.tracker.add(a.key, pendingRetry{attempt: a.number})
+	case err == driver.ErrSkip && a.fallbackKey.conn != nil && (a.fallbackKey.op == OpSQLConnExec || a.fallbackKey.op == OpSQLConnQuery):
+		a.tracker.add(a.fallbackKey, pendingRetry{attempt: a.number})
+	}
+}
+
+// add remembers p until the next attempt of key, forgetting the calls which were not retried within the retry window.
+// Once maxPendingRetries calls are remembered, new ones are not, so that contexts are not retained without bound.
+func (t *retryTracker) add(key retryKey, p pendingRetry) {
+	p.at = time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k, old := range t.pending {
+		if p.at.Sub(old.at) > retryWindow {
+			delete(t.pending, k)
+		}
+	}
+	if len(t.pending) >= maxPendingRetries {
+		return
+	}
+
+	t.pending[key] = p
+}
+
+// setAttempt labels the call with its attempt number if it is a retry
+func (c *call) setAttempt(a attempt) {
+	if c == nil {
+		return
+	}
+
+	if a.number > 1 {
+		c.setLabel("attempt", strconv.Itoa(a.number))
+	}
+}
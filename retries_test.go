@@ -0,0 +1,71 @@
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestRetryTracker(t *testing.T) {
+	tracker := newRetryTracker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := 1; i <= maxBadConnRetries+1; i++ {
+		a := tracker.start(ctx, nil, OpSQLConnExec, "DELETE FROM users")
+		if a.number != i {
+			t.Fatalf("expected attempt %d, got %d", i, a.number)
+		}
+		a.done(driver.ErrBadConn)
+	}
+	if len(tracker.pending) != 0 {
+		t.Errorf("expected the attempt database/sql does not retry not to be remembered, got %v", tracker.pending)
+	}
+
+	inTx := tracker.start(ctx, nil, OpSQLConnExec, "DELETE FROM users")
+	inTx.inTx = true
+	inTx.done(driver.ErrBadConn)
+	if len(tracker.pending) != 0 {
+		t.Errorf("expected attempts within transactions not to be remembered, got %v", tracker.pending)
+	}
+
+	stale := retryKey{ctx: context.WithValue(ctx, retryKey{}, "stale"), op: OpSQLConnQuery}
+	tracker.pending[stale] = pendingRetry{attempt: 1, at: time.Now().Add(-2 * retryWindow)}
+	tracker.start(ctx, nil, OpSQLConnExec, "UPDATE users SET name = ?").done(driver.ErrBadConn)
+	if _, ok := tracker.pending[stale]; ok {
+		t.Error("expected calls not retried within the retry window to be forgotten")
+	}
+	if len(tracker.pending) != 1 {
+		t.Errorf("expected the retried attempt to be remembered, got %v", tracker.pending)
+	}
+
+	for _, shared := range []context.Context{context.Background(), context.TODO()} {
+		tracker.start(shared, nil, OpSQLConnExec, "DELETE FROM sessions").done(driver.ErrBadConn)
+		if a := tracker.start(shared, nil, OpSQLConnExec, "DELETE FROM sessions"); a.number != 1 {
+			t.Errorf("expected the attempts made with a shared context not to be tied together, got attempt %d", a.number)
+		}
+	}
+
+	conn := &connInfo{}
+	tracker.start(ctx, conn, OpSQLConnQuery, "SELECT 1").done(driver.ErrSkip)
+	if a := tracker.start(context.Background(), &connInfo{}, OpSQLPrepare, "SELECT 1"); a.fallbackOp != "" {
+		t.Errorf("expected a prepare on another connection not to be a fallback, got %q", a.fallbackOp)
+	}
+	if a := tracker.start(context.Background(), conn, OpSQLPrepare, "SELECT 1"); a.fallbackOp != OpSQLConnQuery {
+		t.Errorf("expected the prepare on the same connection to fall back from %q, got %q", OpSQLConnQuery, a.fallbackOp)
+	}
+
+	wrapped := retryKey{ctx: context.WithValue(ctx, retryKey{}, "wrapped"), op: OpSQLConnQuery}
+	tracker.start(wrapped.ctx, nil, wrapped.op, "").done(wrappedError{driver.ErrBadConn})
+	if _, ok := tracker.pending[wrapped]; !ok {
+		t.Error("expected attempts failing with a wrapped driver.ErrBadConn to be remembered")
+	}
+}
+
+type wrappedError struct {
+	err error
+}
+
+func (e wrappedError) Error() string { return "wrapped: " + e.err.Error() }
+func (e wrappedError) Unwrap() error { return e.err }
@@ -0,0 +1,18 @@
+package instrumentedsql
+
+import "context"
+
+// QueryRewriter returns the query to run instead of query for a call of op, or query itself to leave it unchanged.
+// See WithQueryRewriter.
+type QueryRewriter func(ctx context.Context, op, query string) string
+
+// rewriteQuery rewrites the query of call, remembering the original if it changed
+func (o opts) rewriteQuery(ctx context.Context, call *Call) {
+	if o.QueryRewriter == nil {
+		return
+	}
+
+	if query := o.QueryRewriter(ctx, call.Op, call.Query); query != call.Query {
+		call.originalQuery, call.Query = call.Query, query
+	}
+}
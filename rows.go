@@ -3,8 +3,6 @@ package instrumentedsql
 import (
 	"context"
 	"database/sql/driver"
-	"io"
-	"time"
 )
 
 // Compile time validation that our types implement the expected interfaces
@@ -22,6 +20,11 @@ type wrappedRows struct {
 	opts
 	ctx    context.Context
 	parent driver.Rows
+	// release is called once the rows are closed, if set
+	release func()
+	leak    *trackedHandle
+	// recording is the recording of the query the rows were returned by, if recorded
+	recording *recording
 }
 
 func (r wrappedRows) Columns() []string {
@@ -29,25 +32,23 @@ func (r wrappedRows) Columns() []string {
 }
 
 func (r wrappedRows) Close() error {
+	if r.release != nil {
+		defer r.release()
+	}
+	r.leak.closed()
+	defer r.recording.write()
+
 	return r.parent.Close()
 }
 
-func (r wrappedRows) Next(dest []driver.Value) (err error) {
-	if !r.hasOpExcluded(OpSQLRowsNext) {
-		span := r.GetSpan(r.ctx).NewChild(OpSQLRowsNext)
-		span.SetLabel("component", "database/sql")
-		defer func() {
-			if err != io.EOF {
-				span.SetError(err)
-			}
-			span.Finish()
-		}()
-
-		start := time.Now()
-		defer func() {
-			r.Log(r.ctx, OpSQLRowsNext, "err", err, "duration", time.Since(start))
-		}()
-	}
+func (r wrappedRows) Next(dest []driver.Value) error {
+	return r.intercept(r.ctx, &Call{Op: OpSQLRowsNext}, func(ctx context.Context) error {
+		if err := r.parent.Next(dest); err != nil {
+			r.recording.rowsEnded(err)
+			return err
+		}
+		r.recording.addRow(dest)
 
-	return r.parent.Next(dest)
+		return nil
+	})
 }
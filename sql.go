@@ -17,4 +17,13 @@ const (
 	OpSQLPing             = "sql-ping"
 	OpSQLDummyPing        = "sql-dummy-ping"
 	OpSQLConnectorConnect = "sql-connector-connect"
+	OpSQLConnServerID     = "sql-conn-server-id"
+	OpSQLPoolStats        = "sql-pool-stats"
+	OpSQLPoolWait         = "sql-pool-wait"
+	OpSQLLeak             = "sql-leak"
+	OpSQLNPlusOne         = "sql-n-plus-one"
+	OpSQLCircuitBreaker   = "sql-circuit-breaker"
+	OpSQLLimiterWait      = "sql-limiter-wait"
+	OpSQLAudit            = "sql-audit"
+	OpSQLExplain          = "sql-explain"
 )
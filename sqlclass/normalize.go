@@ -0,0 +1,96 @@
+package sqlclass
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Normalize returns query with its literals and placeholders replaced by ?, comments removed and whitespace collapsed,
+// so that queries which differ only by their values normalize the same. Lists of values, such as those of IN,
+// are collapsed to a single ?.
+func Normalize(query string) string {
+	d := queryDialect(query)
+	var b bytes.Buffer
+	b.Grow(len(query))
+
+	space := false
+	write := func(s string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(s)
+	}
+
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			space = true
+			i++
+		case ch == '-' && strings.HasPrefix(query[i:], "--"), ch == '#' && d.hashComments:
+			space = true
+			i = skipPast(query, i, "\n")
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			space = true
+			i = skipPast(query, i+2, "*/")
+		case ch == '\'':
+			write("?")
+			i = skipString(query, i, d.backslashEscapes)
+		case isEscapeString(query, i):
+			write("?")
+			i = skipString(query, i+1, true)
+		case ch == '$' && dollarTag(query[i:]) != "":
+			tag := dollarTag(query[i:])
+			write("?")
+			i = skipPast(query, i+len(tag), tag)
+		case ch == '"' || ch == '`' || ch == '[':
+			end := byte(ch)
+			if ch == '[' {
+				end = ']'
+			}
+			j := skipPast(query, i+1, string(end))
+			write(query[i:j])
+			i = j
+		case isLetter(ch):
+			start := i
+			for i < len(query) && isWordByte(query[i]) {
+				i++
+			}
+			write(query[start:i])
+		case isDigit(ch) || ch == '?' || ch == '$' || isNamedPlaceholder(query, i):
+			// Numbers, including decimals and exponents, and placeholders such as ?, $1, :name and @name
+			i++
+			for i < len(query) && (isLetter(query[i]) || isDigit(query[i]) || query[i] == '.') {
+				i++
+			}
+			write("?")
+		default:
+			write(query[i : i+1])
+			i++
+		}
+	}
+
+	return collapseLists(b.String())
+}
+
+// collapseLists collapses lists of values, such as (?, ?, ?) or (?, ?), (?, ?), to a single value
+func collapseLists(query string) string {
+	for _, list := range []string{"?, ?", "?,?", "(?), (?)", "(?),(?)"} {
+		single := list[:strings.IndexByte(list, ',')]
+		for strings.Contains(query, list) {
+			query = strings.Replace(query, list, single, -1)
+		}
+	}
+
+	return query
+}
+
+// isNamedPlaceholder reports whether a placeholder such as :name or @name starts at i, rather than a :: cast
+func isNamedPlaceholder(query string, i int) bool {
+	if query[i] != ':' && query[i] != '@' || i+1 >= len(query) || !isLetter(query[i+1]) {
+		return false
+	}
+
+	return i == 0 || query[i-1] != ':'
+}
@@ -0,0 +1,390 @@
+// Package sqlclass classifies SQL statements by their operation and the tables they touch,
+// without fully parsing them. It skips comments, string literals and quoted identifiers,
+// and looks through common table expressions for the statement they belong to.
+package sqlclass
+
+import "strings"
+
+// Statement is the classification of a SQL statement
+type Statement struct {
+	// Operation is the upper cased leading keyword of the statement, such as SELECT, INSERT, CREATE or CALL.
+	// For statements starting with common table expressions, it is that of the statement following them.
+	// It is empty if the query does not start with a keyword.
+	Operation string
+	// Tables are the tables the statement reads or writes, in order of appearance and without duplicates.
+	// Names are qualified as written in the query and unquoted. Common table expressions are not included.
+	Tables []string
+
+	// writes is set if the statement writes despite its operation, such as through a common table expression,
+	// EXPLAIN ANALYZE, SELECT INTO or a SET which is not of a session setting
+	writes bool
+	// multiple is set if the query holds statements following the first one
+	multiple bool
+	// ambiguous is set if the query is not read-only when read in another dialect, such as when # starts a MySQL
+	// comment rather than a Postgres operator, or when a backslash escapes a quote in MySQL but not in Postgres
+	ambiguous bool
+}
+
+// readOnlyOperations are the operations of statements which do not write
+var readOnlyOperations = map[string]bool{
+	"SELECT":    true,
+	"SHOW":      true,
+	"EXPLAIN":   true,
+	"DESCRIBE":  true,
+	"DESC":      true,
+	"VALUES":    true,
+	"TABLE":     true,
+	"SET":       true,
+	"BEGIN":     true,
+	"START":     true,
+	"COMMIT":    true,
+	"ROLLBACK":  true,
+	"SAVEPOINT": true,
+	"RELEASE":   true,
+}
+
+// ddlOperations are the operations of statements which change the schema
+var ddlOperations = map[string]bool{
+	"CREATE":   true,
+	"ALTER":    true,
+	"DROP":     true,
+	"TRUNCATE": true,
+	"RENAME":   true,
+	"COMMENT":  true,
+}
+
+// writeOperations are the operations which make a common table expression write
+var writeOperations = map[string]bool{
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+	"MERGE":  true,
+}
+
+// sessionSettings are the settings which SET may change in a read-only statement, they only affect the session
+var sessionSettings = map[string]bool{
+	"SEARCH_PATH":        true,
+	"TIMEZONE":           true,
+	"TIME_ZONE":          true,
+	"STATEMENT_TIMEOUT":  true,
+	"LOCK_TIMEOUT":       true,
+	"MAX_EXECUTION_TIME": true,
+	"APPLICATION_NAME":   true,
+	"CLIENT_ENCODING":    true,
+	"NAMES":              true,
+	"DATESTYLE":          true,
+}
+
+// ReadOnly reports whether the statement only reads. It fails closed: statements which are not known to be reads,
+// such as CALL or an empty query, are not considered read-only, nor are queries holding several statements,
+// statements with a common table expression which writes, EXPLAIN ANALYZE which runs the statement it explains,
+// SELECT INTO, SET statements other than of a session setting such as the search path or the time zone, and queries
+// which are not read-only in every SQL dialect.
+func (s Statement) ReadOnly() bool {
+	return readOnlyOperations[s.Operation] && !s.writes && !s.multiple && !s.ambiguous
+}
+
+// DDL reports whether the statement changes the schema
+func (s Statement) DDL() bool {
+	return ddlOperations[s.Operation]
+}
+
+// Table returns the tables of the statement joined with commas
+func (s Statement) Table() string {
+	return strings.Join(s.Tables, ",")
+}
+
+// Classify classifies the first statement of query
+func Classify(query string) Statement {
+	d := queryDialect(query)
+	s := classify(query, d)
+	other := postgresDialect
+	if d == postgresDialect {
+		other = mysqlDialect
+	}
+	s.ambiguous = s.ReadOnly() && !classify(query, other).ReadOnly()
+
+	return s
+}
+
+// classify classifies the first statement of query as read in dialect d
+func classify(query string, d dialect) Statement {
+	tokens, end := tokenize(query, d)
+	p := parser{tokens: tokens}
+
+	var s Statement
+	s.Operation, s.writes, p.ctes = p.operation()
+	s.Tables = p.tables()
+	s.writes = s.writes || p.writes(s.Operation)
+	s.multiple = !isBlank(query[end:])
+
+	return s
+}
+
+type parser struct {
+	tokens []token
+	// ctes are the names of the common table expressions of the statement
+	ctes map[string]bool
+}
+
+// operation returns the operation of the statement, whether any of its common table expressions writes, and their names
+func (p *parser) operation() (string, bool, map[string]bool) {
+	i := skipOpenParens(p.tokens, 0)
+	if !p.isWord(i, "WITH") {
+		return p.word(i), false, nil
+	}
+
+	ctes := make(map[string]bool)
+	writes := false
+	i++
+	if p.isWord(i, "RECURSIVE") {
+		i++
+	}
+	for i < len(p.tokens) {
+		if !p.isName(i) {
+			return "", writes, ctes
+		}
+		ctes[strings.ToLower(p.tokens[i].text)] = true
+		i++
+		if p.isPunct(i, '(') {
+			// Column list
+			i = skipParens(p.tokens, i)
+		}
+		if !p.isWord(i, "AS") {
+			return "", writes, ctes
+		}
+		i++
+		for p.isWord(i, "NOT") || p.isWord(i, "MATERIALIZED") {
+			i++
+		}
+		if !p.isPunct(i, '(') {
+			return "", writes, ctes
+		}
+		if writeOperations[p.word(skipOpenParens(p.tokens, i))] {
+			writes = true
+		}
+		i = skipParens(p.tokens, i)
+		if !p.isPunct(i, ',') {
+			break
+		}
+		i++
+	}
+
+	return p.word(skipOpenParens(p.tokens, i)), writes, ctes
+}
+
+// writes reports whether the statement of operation writes despite its operation being a read
+func (p *parser) writes(operation string) bool {
+	switch operation {
+	case "EXPLAIN", "DESCRIBE", "DESC":
+		// EXPLAIN ANALYZE runs the statement, whether given as a keyword or as an option in parentheses
+		return p.hasWordBefore(len(p.tokens), "ANALYZE") || p.hasWordBefore(len(p.tokens), "ANALYSE")
+	case "SELECT":
+		// SELECT INTO creates a table, or writes a file
+		return p.hasWordBefore(len(p.tokens), "INTO")
+	case "SET":
+		return !p.sessionSetting()
+	default:
+		return false
+	}
+}
+
+// sessionSetting reports whether the statement, a SET, changes one of the sessionSettings of the session
+func (p *parser) sessionSetting() bool {
+	i := 1
+	if p.isWord(i, "SESSION") || p.isWord(i, "LOCAL") {
+		i++
+	}
+	if p.isWord(i, "TIME") && p.isWord(i+1, "ZONE") {
+		return true
+	}
+
+	return sessionSettings[p.word(i)]
+}
+
+// tables returns the tables referenced by the statement
+func (p *parser) tables() []string {
+	var tables []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] && !p.ctes[strings.ToLower(name)] {
+			seen[name] = true
+			tables = append(tables, name)
+		}
+	}
+
+	// subqueries tracks, for every parenthesis the token at i is nested in, whether it encloses a statement,
+	// so that the FROM in EXTRACT(YEAR FROM date) and the like is not taken for that of a statement
+	var subqueries []bool
+	for i := 0; i < len(p.tokens); i++ {
+		t := p.tokens[i]
+		switch {
+		case p.isPunct(i, '('):
+			next := p.word(skipOpenParens(p.tokens, i+1))
+			subqueries = append(subqueries, next == "SELECT" || next == "WITH" || next == "VALUES" || writeOperations[next])
+			continue
+		case p.isPunct(i, ')'):
+			if len(subqueries) > 0 {
+				subqueries = subqueries[:len(subqueries)-1]
+			}
+			continue
+		case t.kind != wordToken:
+			continue
+		case len(subqueries) > 0 && !subqueries[len(subqueries)-1]:
+			continue
+		}
+
+		prev := ""
+		if i > 0 && p.tokens[i-1].kind == wordToken {
+			prev = p.tokens[i-1].upper
+		}
+
+		switch t.upper {
+		case "FROM", "JOIN":
+			i = p.tableList(i+1, true, true, add)
+		case "INTO":
+			if prev == "INSERT" || prev == "REPLACE" || prev == "MERGE" || prev == "IGNORE" {
+				i = p.tableList(i+1, false, false, add)
+			}
+		case "UPDATE":
+			// Not the UPDATE of FOR UPDATE, ON DUPLICATE KEY UPDATE, DO UPDATE or ON UPDATE
+			if prev == "" {
+				i = p.tableList(i+1, true, false, add)
+			}
+		case "TABLE", "TRUNCATE":
+			i = p.tableList(i+1, true, false, add)
+		case "USING":
+			if !p.isPunct(i+1, '(') {
+				i = p.tableList(i+1, false, false, add)
+			}
+		case "ON":
+			// CREATE INDEX name ON table
+			if p.hasWordBefore(i, "INDEX") {
+				i = p.tableList(i+1, false, false, add)
+			}
+		}
+	}
+
+	return tables
+}
+
+// tableList reads the table references starting at i, a comma separated list of them if list is set,
+// and returns the index of the last token read. If calls is set, references followed by parentheses are taken
+// for table functions rather than tables followed by a column list.
+func (p *parser) tableList(i int, list, calls bool, add func(string)) int {
+	for {
+		for p.isWord(i, "IF") || p.isWord(i, "NOT") || p.isWord(i, "EXISTS") || p.isWord(i, "ONLY") || p.isWord(i, "TABLE") {
+			i++
+		}
+		if !p.isName(i) {
+			// A subquery or a keyword, tables within a subquery are read on their own
+			return i - 1
+		}
+
+		name := p.tokens[i].text
+		for p.isPunct(i+1, '.') && p.isName(i+2) {
+			name += "." + p.tokens[i+2].text
+			i += 2
+		}
+		i++
+		if calls && p.isPunct(i, '(') {
+			// A function call rather than a table
+			i = skipParens(p.tokens, i)
+		} else {
+			add(name)
+		}
+
+		// Alias
+		if p.isWord(i, "AS") {
+			i++
+		}
+		if p.isName(i) {
+			i++
+		}
+
+		if !list || !p.isPunct(i, ',') {
+			return i - 1
+		}
+		i++
+	}
+}
+
+// hasWordBefore reports whether word appears in the statement before index i
+func (p *parser) hasWordBefore(i int, word string) bool {
+	for j := 0; j < i; j++ {
+		if p.isWord(j, word) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *parser) word(i int) string {
+	if i < len(p.tokens) && p.tokens[i].kind == wordToken {
+		return p.tokens[i].upper
+	}
+
+	return ""
+}
+
+func (p *parser) isWord(i int, word string) bool {
+	return p.word(i) == word
+}
+
+func (p *parser) isPunct(i int, ch byte) bool {
+	return i < len(p.tokens) && p.tokens[i].kind == punctToken && p.tokens[i].text[0] == ch
+}
+
+// isName reports whether the token at i is an identifier, quoted or not, rather than a keyword
+func (p *parser) isName(i int) bool {
+	if i >= len(p.tokens) {
+		return false
+	}
+
+	t := p.tokens[i]
+	return t.kind == quotedToken || t.kind == wordToken && !keywords[t.upper]
+}
+
+func skipOpenParens(tokens []token, i int) int {
+	for i < len(tokens) && tokens[i].kind == punctToken && tokens[i].text == "(" {
+		i++
+	}
+
+	return i
+}
+
+// skipParens returns the index following the parenthesis closing the one at i
+func skipParens(tokens []token, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		if tokens[i].kind != punctToken {
+			continue
+		}
+
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+
+	return i
+}
+
+// keywords are the keywords which can follow a table reference, and therefore are not taken for a table or its alias
+var keywords = map[string]bool{
+	"SELECT": true, "INSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true, "VALUES": true, "SET": true,
+	"FROM": true, "WHERE": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true,
+	"OUTER": true, "CROSS": true, "NATURAL": true, "ON": true, "USING": true, "GROUP": true, "ORDER": true,
+	"HAVING": true, "LIMIT": true, "OFFSET": true, "FETCH": true, "UNION": true, "INTERSECT": true,
+	"EXCEPT": true, "RETURNING": true, "FOR": true, "WINDOW": true, "AS": true, "WITH": true, "LATERAL": true,
+	"DEFAULT": true, "ADD": true, "DROP": true, "ALTER": true, "RENAME": true, "CASCADE": true,
+	"RESTRICT": true, "WHEN": true, "THEN": true, "AND": true, "OR": true, "NOT": true, "IF": true,
+	"EXISTS": true, "TABLE": true, "ONLY": true, "IGNORE": true, "INTO": true, "LOCK": true, "PARTITION": true,
+	"STRAIGHT_JOIN": true, "OUTPUT": true, "DUPLICATE": true, "CONFLICT": true,
+}
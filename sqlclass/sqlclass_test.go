@@ -0,0 +1,92 @@
+package sqlclass
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		query     string
+		operation string
+		tables    []string
+		readOnly  bool
+	}{
+		{"SELECT * FROM users", "SELECT", []string{"users"}, true},
+		{"  /* app=test */ -- comment\n select id from public.users u join \"Groups\" g on g.id = u.group_id", "SELECT", []string{"public.users", "Groups"}, true},
+		{"SELECT a.id FROM a, b AS bb, `c` WHERE a.id = bb.id", "SELECT", []string{"a", "b", "c"}, true},
+		{"SELECT * FROM users WHERE id IN (SELECT user_id FROM members)", "SELECT", []string{"users", "members"}, true},
+		{"SELECT EXTRACT(YEAR FROM created) FROM users", "SELECT", []string{"users"}, true},
+		{"SELECT * FROM generate_series(1, 10)", "SELECT", nil, true},
+		{"(SELECT 1) UNION (SELECT 2 FROM t)", "SELECT", []string{"t"}, true},
+		{"SELECT 'DELETE FROM x' FROM users WHERE name = 'it''s'", "SELECT", []string{"users"}, true},
+		{"SELECT * FROM users FOR UPDATE", "SELECT", []string{"users"}, true},
+		{"INSERT INTO users (id, name) VALUES ($1, $2)", "INSERT", []string{"users"}, false},
+		{"INSERT INTO users (id) VALUES (?) ON DUPLICATE KEY UPDATE id = id", "INSERT", []string{"users"}, false},
+		{"insert ignore into users select * from staging", "INSERT", []string{"users", "staging"}, false},
+		{"UPDATE users SET name = :name WHERE id = @id", "UPDATE", []string{"users"}, false},
+		{"DELETE FROM users USING groups WHERE users.group_id = groups.id", "DELETE", []string{"users", "groups"}, false},
+		{"CREATE TABLE IF NOT EXISTS users (id int)", "CREATE", []string{"users"}, false},
+		{"CREATE UNIQUE INDEX users_name ON users (name)", "CREATE", []string{"users"}, false},
+		{"DROP TABLE IF EXISTS a, b", "DROP", []string{"a", "b"}, false},
+		{"TRUNCATE TABLE users", "TRUNCATE", []string{"users"}, false},
+		{"CALL refresh_users()", "CALL", nil, false},
+		{"BEGIN", "BEGIN", nil, true},
+		{"WITH recent AS (SELECT * FROM users) SELECT * FROM recent JOIN groups ON true", "SELECT", []string{"users", "groups"}, true},
+		{"WITH RECURSIVE t(n) AS (VALUES (1) UNION ALL SELECT n+1 FROM t) SELECT n FROM t", "SELECT", nil, true},
+		{"WITH gone AS (DELETE FROM users RETURNING id) SELECT * FROM gone", "SELECT", []string{"users"}, false},
+		{"WITH ids AS (SELECT id FROM stale) UPDATE users SET active = false FROM ids", "UPDATE", []string{"stale", "users"}, false},
+		{"DO $$ BEGIN DELETE FROM users; END $$", "DO", nil, false},
+		{"SELECT 1; -- done\n", "SELECT", nil, true},
+		{"SHOW TABLES", "SHOW", nil, true},
+		{"EXPLAIN SELECT * FROM users", "EXPLAIN", []string{"users"}, true},
+		{"EXPLAIN ANALYZE DELETE FROM users", "EXPLAIN", []string{"users"}, false},
+		{"explain (analyze true) update users set name = 'x'", "EXPLAIN", []string{"users"}, false},
+		{"SELECT * INTO backup FROM users", "SELECT", []string{"users"}, false},
+		{"SELECT id INTO OUTFILE '/tmp/users' FROM users", "SELECT", []string{"users"}, false},
+		{"SET GLOBAL read_only = 0", "SET", nil, false},
+		{"SET TRANSACTION READ WRITE", "SET", nil, false},
+		{"SET search_path TO app", "SET", nil, true},
+		{"SET SESSION TIME ZONE 'UTC'", "SET", nil, true},
+		{"WITH recent AS (SELECT * FROM users FOR UPDATE) SELECT * FROM recent", "SELECT", []string{"users"}, true},
+		{"SELECT 1; DELETE FROM users", "SELECT", nil, false},
+		{"SELECT data #>> '{a}' FROM t; DELETE FROM users", "SELECT", []string{"t"}, false},
+		{"SELECT data #>> '{a}' FROM t", "SELECT", []string{"t"}, true},
+		{"SELECT data #- '{a}' FROM t JOIN u ON t.id = u.id", "SELECT", []string{"t", "u"}, true},
+		{"SELECT E'x\\'' ; DELETE FROM users", "SELECT", nil, false},
+		{"SELECT 'a\\' ; DELETE FROM users; --'", "SELECT", nil, false},
+		{"SELECT 'it''s' FROM users # done", "SELECT", []string{"users"}, true},
+		{"", "", nil, false},
+		{"/* unterminated", "", nil, false},
+	}
+
+	for _, test := range tests {
+		s := Classify(test.query)
+		if s.Operation != test.operation || !reflect.DeepEqual(s.Tables, test.tables) || s.ReadOnly() != test.readOnly {
+			t.Errorf("Classify(%q) = %q %q read-only %v, expected %q %q read-only %v",
+				test.query, s.Operation, s.Tables, s.ReadOnly(), test.operation, test.tables, test.readOnly)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		query      string
+		normalized string
+	}{
+		{"SELECT * FROM users WHERE id = 1", "SELECT * FROM users WHERE id = ?"},
+		{"SELECT *\n  FROM users -- by name\n WHERE name = 'it''s' /* app=test */", "SELECT * FROM users WHERE name = ?"},
+		{"SELECT * FROM users WHERE id IN ($1, $2, $3) AND score > 1.5e3", "SELECT * FROM users WHERE id IN (?) AND score > ?"},
+		{"INSERT INTO t1 (a, b) VALUES (?, ?), (?, ?)", "INSERT INTO t1 (a, b) VALUES (?)"},
+		{"SELECT \"Name\" FROM `users` WHERE id = :id AND x::int = @x", "SELECT \"Name\" FROM `users` WHERE id = ? AND x::int = ?"},
+		{"SELECT $body$ text $body$", "SELECT ?"},
+		{"SELECT data #>> '{a}' FROM t WHERE id = 1", "SELECT data #>> ? FROM t WHERE id = ?"},
+		{"SELECT * FROM users WHERE name = 'it\\'s' # by name", "SELECT * FROM users WHERE name = ?"},
+	}
+
+	for _, test := range tests {
+		if normalized := Normalize(test.query); normalized != test.normalized {
+			t.Errorf("Normalize(%q) = %q, expected %q", test.query, normalized, test.normalized)
+		}
+	}
+}
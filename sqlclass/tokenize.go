@@ -0,0 +1,185 @@
+package sqlclass
+
+import "strings"
+
+type tokenKind int
+
+const (
+	// wordToken is a keyword or an unquoted identifier
+	wordToken tokenKind = iota
+	// quotedToken is a quoted identifier, its text is unquoted
+	quotedToken
+	// punctToken is one of ( ) , . ;
+	punctToken
+)
+
+// dialect is how the lexical rules of SQL databases differ in ways which matter to the classification of a query
+type dialect struct {
+	// hashComments is set if # starts a comment, as in MySQL, rather than an operator, as in Postgres
+	hashComments bool
+	// backslashEscapes is set if backslashes escape quotes in every string, as in MySQL, rather than only in
+	// E'' strings, as in Postgres
+	backslashEscapes bool
+}
+
+var (
+	mysqlDialect    = dialect{hashComments: true, backslashEscapes: true}
+	postgresDialect = dialect{}
+)
+
+// queryDialect returns the dialect a query most likely uses, Postgres if it holds one of its JSON operators starting
+// with #, such as #> or #-, and MySQL otherwise
+func queryDialect(query string) dialect {
+	if strings.Contains(query, "#>") || strings.Contains(query, "#-") {
+		return postgresDialect
+	}
+
+	return mysqlDialect
+}
+
+type token struct {
+	kind  tokenKind
+	text  string
+	upper string
+}
+
+// tokenize returns the words, quoted identifiers and punctuation of the first statement of query as read in dialect d,
+// and the index following it. Comments, string literals, numbers, placeholders and operators are skipped.
+func tokenize(query string, d dialect) ([]token, int) {
+	var tokens []token
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == '-' && strings.HasPrefix(query[i:], "--"), ch == '#' && d.hashComments:
+			i = skipPast(query, i, "\n")
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			i = skipPast(query, i+2, "*/")
+		case ch == '\'':
+			i = skipString(query, i, d.backslashEscapes)
+		case isEscapeString(query, i):
+			i = skipString(query, i+1, true)
+		case ch == '$' && dollarTag(query[i:]) != "":
+			tag := dollarTag(query[i:])
+			i = skipPast(query, i+len(tag), tag)
+		case ch == '"' || ch == '`' || ch == '[':
+			end := byte(ch)
+			if ch == '[' {
+				end = ']'
+			}
+			j := strings.IndexByte(query[i+1:], end)
+			if j < 0 {
+				return tokens, len(query)
+			}
+			tokens = append(tokens, token{kind: quotedToken, text: query[i+1 : i+1+j]})
+			i += j + 2
+		case ch == ';':
+			return tokens, i + 1
+		case ch == '(' || ch == ')' || ch == ',' || ch == '.':
+			tokens = append(tokens, token{kind: punctToken, text: query[i : i+1]})
+			i++
+		case isLetter(ch):
+			start := i
+			for i < len(query) && isWordByte(query[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: wordToken, text: query[start:i], upper: strings.ToUpper(query[start:i])})
+		case isDigit(ch) || ch == '$' || ch == ':' || ch == '@':
+			// Numbers and placeholders such as $1, :name and @name
+			i++
+			for i < len(query) && (isLetter(query[i]) || isDigit(query[i])) {
+				i++
+			}
+		default:
+			i++
+		}
+	}
+
+	return tokens, len(query)
+}
+
+// isBlank reports whether query holds nothing but whitespace, comments and semicolons
+func isBlank(query string) bool {
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == '-' && strings.HasPrefix(query[i:], "--"), ch == '#':
+			i = skipPast(query, i, "\n")
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			i = skipPast(query, i+2, "*/")
+		case ch == ';' || ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// skipPast returns the index following the first occurrence of end in query from i, or the length of query
+func skipPast(query string, i int, end string) int {
+	if j := strings.Index(query[i:], end); j >= 0 {
+		return i + j + len(end)
+	}
+
+	return len(query)
+}
+
+// skipString returns the index following the string literal starting at i, quotes are escaped by doubling them,
+// or with a backslash if backslashEscapes is set
+func skipString(query string, i int, backslashEscapes bool) int {
+	for i++; i < len(query); i++ {
+		if query[i] == '\\' && backslashEscapes {
+			i++
+			continue
+		}
+		if query[i] != '\'' {
+			continue
+		}
+		if i+1 < len(query) && query[i+1] == '\'' {
+			i++
+			continue
+		}
+
+		return i + 1
+	}
+
+	return len(query)
+}
+
+// dollarTag returns the tag opening a dollar quoted string at the start of s, such as $$ or $body$, if any
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '$':
+			return s[:i+1]
+		case isLetter(s[i]) || i > 1 && isDigit(s[i]):
+		default:
+			return ""
+		}
+	}
+
+	return ""
+}
+
+func isLetter(ch byte) bool {
+	return ch == '_' || 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z'
+}
+
+func isDigit(ch byte) bool {
+	return '0' <= ch && ch <= '9'
+}
+
+// isEscapeString reports whether a Postgres escape string, such as E'It\'s', starts at i, in which backslashes
+// escape quotes whatever the dialect
+func isEscapeString(query string, i int) bool {
+	if query[i] != 'E' && query[i] != 'e' || i+1 >= len(query) || query[i+1] != '\'' {
+		return false
+	}
+
+	return i == 0 || !isWordByte(query[i-1])
+}
+
+func isWordByte(ch byte) bool {
+	return isLetter(ch) || isDigit(ch) || ch == '$'
+}
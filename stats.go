@@ -0,0 +1,126 @@
+// +build go1.11
+
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// StatsExporter periodically publishes the connection pool statistics of a sql.DB through the logger and metrics sink
+// of the WrappedDriver it was opened with. Statistics are labeled with the labels passed to WithLabels,
+// so they can be correlated with the spans of the same database.
+//
+// Gauges (open, in use and idle connections) are published as is, counters (wait count, wait duration and closed
+// connections) are published as the increase since the previous publication.
+type StatsExporter struct {
+	opts
+	db *sql.DB
+
+	mu      sync.Mutex
+	last    sql.DBStats
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewStatsExporter returns a StatsExporter for db, which must have been opened through a WrappedDriver,
+// either by registering it or through sql.OpenDB with a connector it returned.
+// Call Start to begin publishing.
+func NewStatsExporter(db *sql.DB) (*StatsExporter, error) {
+	o, err := wrappedOpts(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsExporter{opts: o, db: db}, nil
+}
+
+// Start publishes the statistics every interval until Stop is called
+func (e *StatsExporter) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	e.run(ticker.C, ticker.Stop)
+}
+
+// StartWithTicks publishes the statistics every time a value is received from ticks until Stop is called,
+// allowing a fake clock to be used in tests
+func (e *StatsExporter) StartWithTicks(ticks <-chan time.Time) {
+	e.run(ticks, func() {})
+}
+
+func (e *StatsExporter) run(ticks <-chan time.Time, stopTicks func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stop != nil {
+		panic("instrumentedsql: StatsExporter started twice")
+	}
+	e.stop = make(chan struct{})
+	e.stopped = make(chan struct{})
+
+	go func(stop, stopped chan struct{}) {
+		defer close(stopped)
+		defer stopTicks()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticks:
+				e.Publish(context.Background())
+			}
+		}
+	}(e.stop, e.stopped)
+}
+
+// Stop stops publishing and waits for a publication in progress to complete.
+// The exporter can be started again afterwards.
+func (e *StatsExporter) Stop() {
+	e.mu.Lock()
+	stop, stopped := e.stop, e.stopped
+	e.stop, e.stopped = nil, nil
+	e.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-stopped
+}
+
+// Publish publishes the current statistics once
+func (e *StatsExporter) Publish(ctx context.Context) {
+	stats := e.db.Stats()
+
+	e.mu.Lock()
+	last := e.last
+	e.last = stats
+	e.mu.Unlock()
+
+	values := []struct {
+		name  string
+		value float64
+	}{
+		{"sql-pool-max-open", float64(stats.MaxOpenConnections)},
+		{"sql-pool-open", float64(stats.OpenConnections)},
+		{"sql-pool-in-use", float64(stats.InUse)},
+		{"sql-pool-idle", float64(stats.Idle)},
+		{"sql-pool-wait-count", float64(stats.WaitCount - last.WaitCount)},
+		{"sql-pool-wait-duration", (stats.WaitDuration - last.WaitDuration).Seconds()},
+		{"sql-pool-max-idle-closed", float64(stats.MaxIdleClosed - last.MaxIdleClosed)},
+		{"sql-pool-max-lifetime-closed", float64(stats.MaxLifetimeClosed - last.MaxLifetimeClosed)},
+	}
+
+	keyvals := make([]interface{}, 0, 2*(len(values)+len(e.Labels)))
+	for k, v := range e.Labels {
+		keyvals = append(keyvals, k, v)
+	}
+	for _, v := range values {
+		keyvals = append(keyvals, v.name, v.value)
+		e.Observe(ctx, v.name, v.value, e.metricLabels())
+	}
+
+	e.Log(ctx, OpSQLPoolStats, keyvals...)
+}
@@ -0,0 +1,61 @@
+// +build go1.11
+
+package instrumentedsql
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestStatsExporter(t *testing.T) {
+	published := make(chan map[string]string, 16)
+	metrics := MetricsFunc(func(ctx context.Context, name string, value float64, labels map[string]string) {
+		if name == "sql-pool-open" {
+			published <- labels
+		}
+	})
+
+	d := WrapDriver(&driverMock{}, WithMetrics(metrics), WithLabels(map[string]string{"db.instance": "test"}))
+	connector, err := d.OpenConnector("some-dsn")
+	if err != nil {
+		t.Fatalf("unexpected error from wrapped OpenConnector impl: %+v\n", err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	exporter, err := NewStatsExporter(db)
+	if err != nil {
+		t.Fatalf("unexpected error creating stats exporter: %+v\n", err)
+	}
+
+	ticks := make(chan time.Time)
+	exporter.StartWithTicks(ticks)
+	ticks <- time.Now()
+
+	select {
+	case labels := <-published:
+		if labels["db.instance"] != "test" {
+			t.Errorf("expected pool statistics to be labeled with the driver labels, got %v", labels)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected pool statistics to be published on tick")
+	}
+
+	exporter.Stop()
+	select {
+	case ticks <- time.Now():
+		t.Error("expected exporter to stop consuming ticks once stopped")
+	default:
+	}
+}
+
+func TestStatsExporterNotWrapped(t *testing.T) {
+	db := sql.OpenDB(dsnConnector{dsn: "some-dsn", driver: &driverMock{}})
+	defer db.Close()
+
+	if _, err := NewStatsExporter(db); err != ErrNotWrapped {
+		t.Errorf("expected ErrNotWrapped, got %v", err)
+	}
+}
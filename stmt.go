@@ -4,13 +4,24 @@ import (
 	"context"
 	"database/sql/driver"
 	"time"
+
+	"github.com/luna-duclos/instrumentedsql/sqlclass"
 )
 
 type wrappedStmt struct {
 	opts
-	ctx    context.Context
-	query  string
-	parent driver.Stmt
+	ctx context.Context
+	// parentConn is the wrapped connection the statement was prepared on
+	parentConn driver.Conn
+	query      string
+	// originalQuery is the query before it was rewritten, if it was
+	originalQuery string
+	// statement is the classification of query, computed when the statement is prepared
+	statement sqlclass.Statement
+	parent    driver.Stmt
+	// fallbackOp is the op database/sql fell back from when preparing this statement, if any
+	fallbackOp string
+	leak       *trackedHandle
 }
 
 // Compile time validation that our types implement the expected interfaces
@@ -20,158 +31,212 @@ var (
 	_ driver.StmtQueryContext = wrappedStmt{}
 )
 
-func (s wrappedStmt) Close() (err error) {
-	if !s.hasOpExcluded(OpSQLStmtClose) {
-		span := s.GetSpan(s.ctx).NewChild(OpSQLStmtClose)
-		span.SetLabel("component", "database/sql")
-		start := time.Now()
-		defer func() {
-			span.SetError(err)
-			span.Finish()
-			s.Log(s.ctx, OpSQLStmtClose, "err", err, "duration", time.Since(start))
-		}()
+// newCall returns the call of op on the statement, labeled with the op the statement falls back from if any
+func (s wrappedStmt) newCall(op string, args []driver.NamedValue) *Call {
+	call := &Call{Op: op, fallbackOp: s.fallbackOp}
+	if op != OpSQLStmtClose {
+		call.Query, call.Args, call.originalQuery = s.query, args, s.originalQuery
+		call.statement, call.classifiedQuery = s.statement, s.query
 	}
 
-	return s.parent.Close()
+	return call
+}
+
+func (s wrappedStmt) Close() error {
+	call := s.newCall(OpSQLStmtClose, nil)
+	return s.intercept(s.ctx, call, func(ctx context.Context) error {
+		s.leak.closed()
+
+		return s.parent.Close()
+	})
 }
 
 func (s wrappedStmt) NumInput() int {
 	return s.parent.NumInput()
 }
 
-func (s wrappedStmt) Exec(args []driver.Value) (res driver.Result, err error) {
-	if !s.hasOpExcluded(OpSQLStmtExec) {
-		span := s.GetSpan(s.ctx).NewChild(OpSQLStmtExec)
-		span.SetLabel("component", "database/sql")
-		span.SetLabel("query", s.query)
-		if !s.OmitArgs {
-			span.SetLabel("args", formatArgs(args))
+func (s wrappedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	call := s.newCall(OpSQLStmtExec, valueToNamedValue(args))
+	err := s.intercept(s.ctx, call, func(ctx context.Context) error {
+		dargs, err := namedValueToValue(call.Args)
+		if err != nil {
+			return err
 		}
-		start := time.Now()
-		defer func() {
-			span.SetError(err)
-			span.Finish()
-			logQuery(s.ctx, s.opts, OpSQLStmtExec, s.query, err, args, start)
-		}()
-	}
 
-	res, err = s.parent.Exec(args)
+		res, err := s.parent.Exec(dargs)
+		if err != nil {
+			return err
+		}
+		call.call.recordResult(res)
+
+		call.Result = wrappedResult{opts: s.opts, ctx: s.ctx, parent: res}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return wrappedResult{opts: s.opts, ctx: s.ctx, parent: res}, nil
+	return call.Result, nil
 }
 
-func (s wrappedStmt) Query(args []driver.Value) (rows driver.Rows, err error) {
-	if !s.hasOpExcluded(OpSQLStmtQuery) {
-		span := s.GetSpan(s.ctx).NewChild(OpSQLStmtQuery)
-		span.SetLabel("component", "database/sql")
-		span.SetLabel("query", s.query)
-		if !s.OmitArgs {
-			span.SetLabel("args", formatArgs(args))
+func (s wrappedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	call := s.newCall(OpSQLStmtQuery, valueToNamedValue(args))
+	err := s.intercept(s.ctx, call, func(ctx context.Context) error {
+		dargs, err := namedValueToValue(call.Args)
+		if err != nil {
+			return err
+		}
+
+		rows, err := s.parent.Query(dargs)
+		if err != nil {
+			return err
 		}
-		start := time.Now()
-		defer func() {
-			span.SetError(err)
-			span.Finish()
-			logQuery(s.ctx, s.opts, OpSQLStmtQuery, s.query, err, args, start)
-		}()
-	}
 
-	rows, err = s.parent.Query(args)
+		call.Rows = wrappedRows{opts: s.opts, ctx: s.ctx, parent: rows, leak: s.track(s.ctx, "rows", s.query), recording: call.call.recordRows(rows)}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return wrappedRows{opts: s.opts, ctx: s.ctx, parent: rows}, nil
+	return call.Rows, nil
 }
 
 func (s wrappedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (res driver.Result, err error) {
-	if !s.hasOpExcluded(OpSQLStmtExec) {
-		span := s.GetSpan(ctx).NewChild(OpSQLStmtExec)
-		span.SetLabel("component", "database/sql")
-		span.SetLabel("query", s.query)
-		if !s.OmitArgs {
-			span.SetLabel("args", formatArgs(args))
+	attempt := s.startAttempt(ctx, OpSQLStmtExec, s.query)
+	defer func() {
+		attempt.done(err)
+	}()
+
+	call := s.newCall(OpSQLStmtExec, args)
+	call.attempt = attempt
+	var explain func()
+	err = s.intercept(ctx, call, func(ctx context.Context) (err error) {
+		if err := s.guardQuery(ctx, call); err != nil {
+			return err
+		}
+		timeout, err := s.enforceTimeout(ctx, call)
+		if err != nil {
+			return err
 		}
-		start := time.Now()
 		defer func() {
-			span.SetError(err)
-			span.Finish()
-			logQuery(ctx, s.opts, OpSQLStmtExec, s.query, err, args, start)
+			err = timeout.check(err)
+			timeout.release()
+		}()
+		ctx = timeout.context(ctx)
+		slot, err := s.acquireSlot(ctx, call)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			slot.release()
+		}()
+		circuit, err := s.enterCircuit(ctx, call)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			circuit.done(err)
 		}()
-	}
 
-	if stmtExecContext, ok := s.parent.(driver.StmtExecContext); ok {
-		res, err := stmtExecContext.ExecContext(ctx, args)
+		fault, err := s.injectFault(ctx, call.call, call.Op, s.query)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		defer func() {
+			if dropped, dropErr := fault.drop(call.Result, err); dropped {
+				call.Result, err = nil, dropErr
+			}
+		}()
 
-		return wrappedResult{opts: s.opts, ctx: ctx, parent: res}, nil
-	}
+		start := time.Now()
+		res, err := execStmt(ctx, s.parent, call.Args)
+		if err != nil {
+			return err
+		}
+		call.call.recordResult(res)
+		// The statement is explained once it returns, when the connection is free again
+		explain = s.explainSlow(ctx, s.parentConn, call, start)
 
-	// Fallback implementation
-	dargs, err := namedValueToValue(args)
+		call.Result = wrappedResult{opts: s.opts, ctx: ctx, parent: res}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	select {
-	default:
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	}
-
-	res, err = s.parent.Exec(dargs)
-	if err != nil {
-		return nil, err
+	if explain != nil {
+		explain()
 	}
 
-	return wrappedResult{opts: s.opts, ctx: ctx, parent: res}, nil
+	return call.Result, nil
 }
 
 func (s wrappedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (rows driver.Rows, err error) {
-	if !s.hasOpExcluded(OpSQLStmtQuery) {
-		span := s.GetSpan(ctx).NewChild(OpSQLStmtQuery)
-		span.SetLabel("component", "database/sql")
-		span.SetLabel("query", s.query)
-		if !s.OmitArgs {
-			span.SetLabel("args", formatArgs(args))
+	attempt := s.startAttempt(ctx, OpSQLStmtQuery, s.query)
+	defer func() {
+		attempt.done(err)
+	}()
+
+	call := s.newCall(OpSQLStmtQuery, args)
+	call.attempt = attempt
+	err = s.intercept(ctx, call, func(ctx context.Context) (err error) {
+		if err := s.guardQuery(ctx, call); err != nil {
+			return err
+		}
+		timeout, err := s.enforceTimeout(ctx, call)
+		if err != nil {
+			return err
 		}
-		start := time.Now()
 		defer func() {
-			span.SetError(err)
-			span.Finish()
-			logQuery(ctx, s.opts, OpSQLStmtQuery, s.query, err, args, start)
+			// The rows release the timeout once closed
+			if err = timeout.check(err); err != nil {
+				timeout.release()
+			}
 		}()
-	}
-
-	if stmtQueryContext, ok := s.parent.(driver.StmtQueryContext); ok {
-		rows, err := stmtQueryContext.QueryContext(ctx, args)
+		ctx = timeout.context(ctx)
+		slot, err := s.acquireSlot(ctx, call)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		defer func() {
+			// The rows release the slot once closed
+			if err != nil {
+				slot.release()
+			}
+		}()
+		circuit, err := s.enterCircuit(ctx, call)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			circuit.done(err)
+		}()
 
-		return wrappedRows{opts: s.opts, ctx: ctx, parent: rows}, nil
-	}
-
-	dargs, err := namedValueToValue(args)
-	if err != nil {
-		return nil, err
-	}
+		fault, err := s.injectFault(ctx, call.call, call.Op, s.query)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if dropped, dropErr := fault.drop(call.Rows, err); dropped {
+				call.Rows, err = nil, dropErr
+			}
+		}()
 
-	select {
-	default:
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	}
+		start := time.Now()
+		rows, err := queryStmt(ctx, s.parent, call.Args)
+		if err != nil {
+			return err
+		}
 
-	rows, err = s.parent.Query(dargs)
+		// The query is explained once the rows are closed, when the connection is free again
+		explain := s.explainSlow(ctx, s.parentConn, call, start)
+		slot.claim()
+		call.Rows = wrappedRows{opts: s.opts, ctx: ctx, parent: rows, release: releaseAll(timeout.release, slot.release, explain), leak: s.track(ctx, "rows", s.query), recording: call.call.recordRows(rows)}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return wrappedRows{opts: s.opts, ctx: ctx, parent: rows}, nil
+	return call.Rows, nil
 }
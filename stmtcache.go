@@ -0,0 +1,169 @@
+package instrumentedsql
+
+import (
+	"container/list"
+	"context"
+	"database/sql/driver"
+	"strconv"
+	"sync"
+)
+
+// stmtCache is a per connection LRU cache of prepared statements keyed by query,
+// used to run ExecContext and QueryContext calls on the connection through prepared statements.
+type stmtCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// cachedStmt is a statement in the cache. It is closed once evicted and no longer in use.
+type cachedStmt struct {
+	query   string
+	stmt    driver.Stmt
+	refs    int
+	evicted bool
+}
+
+func newStmtCache(size int) *stmtCache {
+	return &stmtCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the statement for query, preparing it on conn if it is not cached yet.
+// The hit or miss and any evictions are labeled on call. The returned release function must be called
+// once the statement, and any rows returned by it, are no longer in use.
+func (sc *stmtCache) get(ctx context.Context, call *call, conn driver.Conn, query string) (driver.Stmt, func(), error) {
+	sc.mu.Lock()
+	if elem, ok := sc.entries[query]; ok {
+		sc.lru.MoveToFront(elem)
+		entry := elem.Value.(*cachedStmt)
+		entry.refs++
+		sc.mu.Unlock()
+
+		call.setLabel("stmt_cache", "hit")
+		return entry.stmt, sc.releaser(entry), nil
+	}
+	sc.mu.Unlock()
+
+	call.setLabel("stmt_cache", "miss")
+
+	var stmt driver.Stmt
+	var err error
+	if connPrepareCtx, ok := conn.(driver.ConnPrepareContext); ok {
+		stmt, err = connPrepareCtx.PrepareContext(ctx, query)
+	} else {
+		stmt, err = conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry := &cachedStmt{query: query, stmt: stmt, refs: 1}
+
+	sc.mu.Lock()
+	if _, ok := sc.entries[query]; ok {
+		// Prepared concurrently, leave the cached one in place and close this one once released
+		entry.evicted = true
+		sc.mu.Unlock()
+
+		return stmt, sc.releaser(entry), nil
+	}
+
+	sc.entries[query] = sc.lru.PushFront(entry)
+	evictions := 0
+	var unused []*cachedStmt
+	for sc.lru.Len() > sc.size {
+		oldest := sc.lru.Back()
+		sc.lru.Remove(oldest)
+		old := oldest.Value.(*cachedStmt)
+		delete(sc.entries, old.query)
+		old.evicted = true
+		if old.refs == 0 {
+			unused = append(unused, old)
+		}
+		evictions++
+	}
+	sc.mu.Unlock()
+
+	for _, old := range unused {
+		_ = old.stmt.Close()
+	}
+	if evictions > 0 {
+		call.setLabel("stmt_cache_evictions", strconv.Itoa(evictions))
+	}
+
+	return stmt, sc.releaser(entry), nil
+}
+
+// releaser returns a function marking one use of entry done, closing it if it was evicted in the mean time
+func (sc *stmtCache) releaser(entry *cachedStmt) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			sc.mu.Lock()
+			entry.refs--
+			closeStmt := entry.evicted && entry.refs == 0
+			sc.mu.Unlock()
+
+			if closeStmt {
+				_ = entry.stmt.Close()
+			}
+		})
+	}
+}
+
+// close closes all cached statements, it is called when the connection is closed
+func (sc *stmtCache) close() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for elem := sc.lru.Front(); elem != nil; elem = elem.Next() {
+		_ = elem.Value.(*cachedStmt).stmt.Close()
+	}
+	sc.entries = make(map[string]*list.Element)
+	sc.lru.Init()
+}
+
+// execStmt executes stmt with args, falling back to Exec if it does not implement driver.StmtExecContext
+func execStmt(ctx context.Context, stmt driver.Stmt, args []driver.NamedValue) (driver.Result, error) {
+	if stmtExecContext, ok := stmt.(driver.StmtExecContext); ok {
+		return stmtExecContext.ExecContext(ctx, args)
+	}
+
+	dargs, err := namedValueToValue(args)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	default:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return stmt.Exec(dargs)
+}
+
+// queryStmt queries stmt with args, falling back to Query if it does not implement driver.StmtQueryContext
+func queryStmt(ctx context.Context, stmt driver.Stmt, args []driver.NamedValue) (driver.Rows, error) {
+	if stmtQueryContext, ok := stmt.(driver.StmtQueryContext); ok {
+		return stmtQueryContext.QueryContext(ctx, args)
+	}
+
+	dargs, err := namedValueToValue(args)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	default:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return stmt.Query(dargs)
+}
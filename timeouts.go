@@ -0,0 +1,192 @@
+package instrumentedsql
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The kinds of timeouts enforced by the wrapped driver, used as the value of the timeout_enforced label
+const (
+	TimeoutKindOp     = "op"
+	TimeoutKindBudget = "budget"
+)
+
+// TimeoutError is returned for calls which exceeded a timeout enforced by the wrapped driver,
+// see WithOpTimeouts and WithSQLBudget. It unwraps to context.DeadlineExceeded.
+type TimeoutError struct {
+	Op string
+	// Kind is either TimeoutKindOp or TimeoutKindBudget
+	Kind string
+	// Timeout is the time the call was allowed to take, it is zero for calls rejected because the budget was spent
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Timeout == 0 {
+		return "instrumentedsql: " + e.Op + " rejected, SQL time budget exhausted"
+	}
+
+	return "instrumentedsql: " + e.Op + " exceeded its " + e.Kind + " timeout of " + e.Timeout.String()
+}
+
+// Unwrap returns context.DeadlineExceeded
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// isTimeoutError reports whether err is or wraps a TimeoutError
+func isTimeoutError(err error) bool {
+	for ; err != nil; err = unwrapError(err) {
+		if _, ok := err.(*TimeoutError); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+type sqlBudgetKey struct{}
+
+// sqlBudget is the SQL time left to the calls made with a context returned by WithSQLBudget
+type sqlBudget struct {
+	mu        sync.Mutex
+	remaining time.Duration
+}
+
+// WithSQLBudget returns a context allowing the calls made with it through any wrapped driver to spend at most
+// budget in total, such as for a single request. Each statement executed, queried or prepared is given the time
+// left as its timeout and the time it takes is deducted, reading the rows of a query included.
+// Once the budget is spent, calls fail with a TimeoutError without reaching the database.
+func WithSQLBudget(ctx context.Context, budget time.Duration) context.Context {
+	return context.WithValue(ctx, sqlBudgetKey{}, &sqlBudget{remaining: budget})
+}
+
+// SQLBudgetRemaining returns the SQL time left in ctx, and whether ctx was returned by WithSQLBudget
+func SQLBudgetRemaining(ctx context.Context) (time.Duration, bool) {
+	b, ok := ctx.Value(sqlBudgetKey{}).(*sqlBudget)
+	if !ok {
+		return 0, false
+	}
+
+	return b.left(), true
+}
+
+func (b *sqlBudget) left() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.remaining
+}
+
+func (b *sqlBudget) spend(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remaining -= d
+}
+
+// enforcedTimeout is a timeout enforced on a call by deriving a context with a deadline from that of the call
+type enforcedTimeout struct {
+	call    *Call
+	ctx     context.Context
+	parent  context.Context
+	cancel  context.CancelFunc
+	kind    string
+	timeout time.Duration
+	budget  *sqlBudget
+	start   time.Time
+	once    sync.Once
+}
+
+// enforceTimeout derives the context to forward call with, if a timeout is to be enforced on it.
+// It returns a TimeoutError if the SQL time budget of ctx is already spent.
+// The returned timeout must be released once the call, and the rows it returns if any, are done.
+func (o opts) enforceTimeout(ctx context.Context, call *Call) (*enforcedTimeout, error) {
+	if ctx == nil {
+		return nil, nil
+	}
+
+	t := &enforcedTimeout{call: call, ctx: ctx, parent: ctx, start: time.Now()}
+	if timeout, ok := o.OpTimeouts[call.Op]; ok && timeout > 0 {
+		t.kind, t.timeout = TimeoutKindOp, timeout
+	}
+	if b, ok := ctx.Value(sqlBudgetKey{}).(*sqlBudget); ok {
+		t.budget = b
+		left := b.left()
+		if left <= 0 {
+			call.call.setLabel("timeout_enforced", TimeoutKindBudget)
+			return nil, &TimeoutError{Op: call.Op, Kind: TimeoutKindBudget}
+		}
+		if t.timeout == 0 || left < t.timeout {
+			t.kind, t.timeout = TimeoutKindBudget, left
+		}
+	}
+	if t.timeout == 0 {
+		return nil, nil
+	}
+
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > t.timeout {
+		t.ctx, t.cancel = context.WithTimeout(ctx, t.timeout)
+		call.call.setLabel("timeout", t.timeout.String())
+	}
+
+	return t, nil
+}
+
+// context returns the context to forward the call with
+func (t *enforcedTimeout) context(ctx context.Context) context.Context {
+	if t == nil || t.cancel == nil {
+		return ctx
+	}
+
+	return t.ctx
+}
+
+// check returns a TimeoutError in place of err if the call failed because the enforced timeout expired
+func (t *enforcedTimeout) check(err error) error {
+	if t == nil || t.cancel == nil || err == nil {
+		return err
+	}
+	if t.ctx.Err() != context.DeadlineExceeded || t.parent.Err() != nil {
+		return err
+	}
+
+	t.call.call.setLabel("timeout_enforced", t.kind)
+	return &TimeoutError{Op: t.call.Op, Kind: t.kind, Timeout: t.timeout}
+}
+
+// release cancels the derived context and deducts the time taken from the budget, at most once
+func (t *enforcedTimeout) release() {
+	if t == nil {
+		return
+	}
+
+	t.once.Do(func() {
+		if t.cancel != nil {
+			t.cancel()
+		}
+		if t.budget != nil {
+			t.budget.spend(time.Since(t.start))
+		}
+	})
+}
+
+// releaseAll returns a function calling every non nil release function, or nil if there is none
+func releaseAll(releases ...func()) func() {
+	var funcs []func()
+	for _, release := range releases {
+		if release != nil {
+			funcs = append(funcs, release)
+		}
+	}
+	if len(funcs) == 0 {
+		return nil
+	}
+
+	return func() {
+		for _, release := range funcs {
+			release()
+		}
+	}
+}
@@ -3,7 +3,6 @@ package instrumentedsql
 import (
 	"context"
 	"database/sql/driver"
-	"time"
 )
 
 type wrappedTx struct {
@@ -17,32 +16,32 @@ var (
 	_ driver.Tx = wrappedTx{}
 )
 
-func (t wrappedTx) Commit() (err error) {
-	if !t.hasOpExcluded(OpSQLTxCommit) {
-		span := t.GetSpan(t.ctx).NewChild(OpSQLTxCommit)
-		span.SetLabel("component", "database/sql")
-		start := time.Now()
-		defer func() {
-			span.SetError(err)
-			span.Finish()
-			t.Log(t.ctx, OpSQLTxCommit, "err", err, "duration", time.Since(start))
-		}()
-	}
-
-	return t.parent.Commit()
+func (t wrappedTx) Commit() error {
+	call := &Call{Op: OpSQLTxCommit}
+	defer t.conn.endTx()
+
+	return t.intercept(t.ctx, call, func(ctx context.Context) error {
+		fault, err := t.injectFault(ctx, call.call, call.Op, "")
+		if err != nil {
+			return err
+		}
+
+		_, err = fault.drop(nil, t.parent.Commit())
+		return err
+	})
 }
 
-func (t wrappedTx) Rollback() (err error) {
-	if !t.hasOpExcluded(OpSQLTxRollback) {
-		span := t.GetSpan(t.ctx).NewChild(OpSQLTxRollback)
-		span.SetLabel("component", "database/sql")
-		start := time.Now()
-		defer func() {
-			span.SetError(err)
-			span.Finish()
-			t.Log(t.ctx, OpSQLTxRollback, "err", err, "duration", time.Since(start))
-		}()
-	}
-
-	return t.parent.Rollback()
-}
\ No newline at end of file
+func (t wrappedTx) Rollback() error {
+	call := &Call{Op: OpSQLTxRollback}
+	defer t.conn.endTx()
+
+	return t.intercept(t.ctx, call, func(ctx context.Context) error {
+		fault, err := t.injectFault(ctx, call.call, call.Op, "")
+		if err != nil {
+			return err
+		}
+
+		_, err = fault.drop(nil, t.parent.Rollback())
+		return err
+	})
+}